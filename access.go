@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ghodss/yaml"
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flagReadAuth only shows reports to the members of the teams they belong to, and of the orgs open to anyone, and the
+// metrics to those who may read everything
+var flagReadAuth = os.Getenv("READ_AUTH") == "true"
+
+// flagTrustProxyHeaders takes the reader from the X-Forwarded-User and X-Forwarded-Email headers set by an
+// authenticating proxy in front of the download server, only enable it if nothing else can reach the server
+var flagTrustProxyHeaders = os.Getenv("READ_AUTH_PROXY_HEADERS") == "true"
+
+const readAccessConfigMap = "jenkins-x-reports-read-access"
+const readAccessKey = "access.yaml"
+
+// readAccessConfig is read from the access.yaml key of the jenkins-x-reports-read-access ConfigMap, e.g.
+//
+//	teams:
+//	  frontend: ["myorg/web-*"]
+//	  platform: ["myorg/*", "infra/*"]
+//	anonymous: ["opensource-org/*"]
+//
+// teams are the names of jenkins.io/v1 Teams and the org/app patterns their members may read, anonymous lists
+// what anyone may read
+type readAccessConfig struct {
+	Teams     map[string][]string `json:"teams"`
+	Anonymous []string            `json:"anonymous"`
+}
+
+// reader is who is reading reports, along with the org/app patterns they may read
+type reader struct {
+	Name  string
+	Teams []string
+	Allow []string
+}
+
+type readerKey struct{}
+
+// readAccess is the configuration along with the Users and Teams it refers to, reloaded every minute
+type readAccess struct {
+	config *readAccessConfig
+	users  []jenkinsxv1.User
+	teams  []jenkinsxv1.Team
+	loaded time.Time
+}
+
+var readAccessLock sync.Mutex
+var cachedReadAccess *readAccess
+
+// everyone may read everything when reads aren't authorized
+var everyone = &reader{Name: "anonymous", Allow: []string{"*"}}
+
+// authorizeReads passes requests for reports and the API on to h if the reader may read the org or app they are
+// for, listings are filtered further down using the reader stored in the request. Denied reads are audited.
+func authorizeReads(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !flagReadAuth {
+			h.ServeHTTP(w, r)
+			return
+		}
+		rd, err := authenticateReader(r)
+		if err != nil {
+			renderError(w, "CANT_AUTHORIZE", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		org, app, listing := requestedApp(r)
+		allowed := true
+		switch {
+		case app != "":
+			allowed = rd.allows(org, app)
+		case org != "":
+			allowed = rd.allowsOrg(org) && (!listing || rd.allows(org, "*"))
+		case listing:
+			allowed = rd.allows("*", "*")
+		}
+		if !allowed {
+			auditDeniedRead(r, rd, org, app)
+			if rd.Name == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="jenkins-x-reports"`)
+				renderError(w, "MUST_AUTHENTICATE", http.StatusUnauthorized)
+				return
+			}
+			renderError(w, "NOT_ALLOWED_TO_READ", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), readerKey{}, rd)))
+	})
+}
+
+// authorizeMetrics only passes requests for the metrics on to h if the reader may read everything, as they are
+// labelled with the orgs and apps of every team. Prometheus has to scrape with the token of a service account that
+// is a User of a Team allowed "*".
+func authorizeMetrics(h http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !flagReadAuth {
+			h(w, r)
+			return
+		}
+		rd, err := authenticateReader(r)
+		if err != nil {
+			renderError(w, "CANT_AUTHORIZE", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if !rd.allows("*", "*") {
+			auditDeniedRead(r, rd, "", "")
+			if rd.Name == "" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="jenkins-x-reports"`)
+				renderError(w, "MUST_AUTHENTICATE", http.StatusUnauthorized)
+				return
+			}
+			renderError(w, "NOT_ALLOWED_TO_READ", http.StatusForbidden)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// requestedApp returns the org and app a request for a report or the API is about, and whether it is a directory
+// listing that can't be filtered. API paths are split like the API splits them, paths the API can't split are about
+// nothing as the API rejects them anyway.
+func requestedApp(r *http.Request) (string, string, bool) {
+	if strings.HasPrefix(r.URL.Path, apiPrefix) {
+		parts, err := splitEscapedPath(strings.TrimPrefix(r.URL.EscapedPath(), apiPrefix))
+		if err != nil || len(parts) < 2 || parts[0] != "orgs" {
+			return "", "", false
+		}
+		if len(parts) < 4 {
+			return parts[1], "", false
+		}
+		return parts[1], parts[3], false
+	}
+	parts := splitPath(r.URL.Path)
+	listing := strings.HasSuffix(r.URL.Path, "/") && !wantsRendered(r)
+	switch len(parts) {
+	case 0:
+		return "", "", listing
+	case 1:
+		return parts[0], "", listing
+	}
+	return parts[0], parts[1], listing
+}
+
+// requestReader returns who is reading, which is everyone when reads aren't authorized
+func requestReader(r *http.Request) *reader {
+	rd, ok := r.Context().Value(readerKey{}).(*reader)
+	if !ok {
+		return everyone
+	}
+	return rd
+}
+
+func auditDeniedRead(r *http.Request, rd *reader, org string, app string) {
+	name := rd.Name
+	if name == "" {
+		name = "anonymous"
+	}
+	deniedReadsTotal.add(1, org)
+	log.Printf("AUDIT denied read of %s by %s (teams: %s) from %s for %s/%s\n", r.URL.Path, name,
+		strings.Join(rd.Teams, ","), r.RemoteAddr, org, app)
+}
+
+// authenticateReader works out who is reading from a bearer token or the headers of an authenticating proxy, and
+// what they may read from the Teams they are a member of. Anyone else may only read what is open to anyone.
+func authenticateReader(r *http.Request) (*reader, error) {
+	access, err := loadReadAccess()
+	if err != nil {
+		return nil, err
+	}
+	rd := &reader{Allow: access.config.Anonymous}
+	var names []string
+	if token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "); token != r.Header.Get("Authorization") {
+		username, err := reviewToken(strings.TrimSpace(token))
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, username)
+	}
+	if flagTrustProxyHeaders {
+		names = append(names, r.Header.Get("X-Forwarded-User"), r.Header.Get("X-Forwarded-Email"))
+	}
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if rd.Name == "" {
+			rd.Name = name
+		}
+		user := access.user(name)
+		if user == nil {
+			continue
+		}
+		rd.Name = user.Name
+		for _, team := range access.teams {
+			if isTeamMember(&team, user) {
+				rd.Teams = append(rd.Teams, team.Name)
+				rd.Allow = append(rd.Allow, access.config.Teams[team.Name]...)
+			}
+		}
+		break
+	}
+	return rd, nil
+}
+
+// user finds the User a name belongs to, which is a service account username, a git login, an email address or the
+// name of the User itself. The service account of a User is in the namespace of the User, a service account of the
+// same name in another namespace isn't the User.
+func (access *readAccess) user(name string) *jenkinsxv1.User {
+	serviceAccount := ""
+	if strings.HasPrefix(name, "system:serviceaccount:") {
+		serviceAccount = name
+	}
+	for i, u := range access.users {
+		namespace := u.Namespace
+		if namespace == "" {
+			namespace = cmNamespace
+		}
+		for _, details := range []jenkinsxv1.UserDetails{u.Spec, u.User} {
+			if (serviceAccount != "" && details.ServiceAccount != "" &&
+				serviceAccount == fmt.Sprintf("system:serviceaccount:%s:%s", namespace, details.ServiceAccount)) ||
+				(serviceAccount == "" && (details.Login == name || (details.Email != "" && details.Email == name))) {
+				return &access.users[i]
+			}
+		}
+		if u.Name == name {
+			return &access.users[i]
+		}
+	}
+	return nil
+}
+
+func isTeamMember(team *jenkinsxv1.Team, user *jenkinsxv1.User) bool {
+	for _, member := range team.Spec.Members {
+		if member == user.Name || (user.Spec.Login != "" && member == user.Spec.Login) {
+			return true
+		}
+	}
+	return false
+}
+
+func loadReadAccess() (*readAccess, error) {
+	readAccessLock.Lock()
+	defer readAccessLock.Unlock()
+	if cachedReadAccess != nil && time.Since(cachedReadAccess.loaded) < authCacheTTL {
+		return cachedReadAccess, nil
+	}
+	access := &readAccess{config: &readAccessConfig{}, loaded: time.Now()}
+	cm, err := kubernetesClient.CoreV1().ConfigMaps(cmNamespace).Get(readAccessConfigMap, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, observeKubernetes("get_config_map", err)
+	}
+	if err == nil {
+		err = yaml.Unmarshal([]byte(cm.Data[readAccessKey]), access.config)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid %s in ConfigMap %s: %s", readAccessKey, readAccessConfigMap, err))
+		}
+	}
+	users, err := jenkinsClient.JenkinsV1().Users(cmNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, observeKubernetes("list_users", err)
+	}
+	access.users = users.Items
+	teams, err := jenkinsClient.JenkinsV1().Teams(cmNamespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, observeKubernetes("list_teams", err)
+	}
+	access.teams = teams.Items
+	cachedReadAccess = access
+	return access, nil
+}
+
+// allows tells whether the reader may read the reports of an app, an org on its own allows all of its apps
+func (rd *reader) allows(org string, app string) bool {
+	for _, pattern := range rd.Allow {
+		if !strings.Contains(pattern, "/") {
+			pattern += "/*"
+		}
+		if pattern == "*/*" {
+			return true
+		}
+		if matched, _ := path.Match(pattern, org+"/"+app); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsOrg tells whether the reader may read the reports of any app of an org
+func (rd *reader) allowsOrg(org string) bool {
+	for _, pattern := range rd.Allow {
+		if pattern == "*" || pattern == "*/*" {
+			return true
+		}
+		if matched, _ := path.Match(strings.SplitN(pattern, "/", 2)[0], org); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// visibleOrgs keeps the orgs the reader may read any app of
+func (rd *reader) visibleOrgs(orgs []string) []string {
+	visible := []string{}
+	for _, org := range orgs {
+		if rd.allowsOrg(org) {
+			visible = append(visible, org)
+		}
+	}
+	return visible
+}
+
+// visibleApps keeps the apps of an org the reader may read
+func (rd *reader) visibleApps(org string, apps []string) []string {
+	visible := []string{}
+	for _, app := range apps {
+		if rd.allows(org, app) {
+			visible = append(visible, app)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestedApp(t *testing.T) {
+	for _, test := range []struct {
+		path    string
+		org     string
+		app     string
+		listing bool
+	}{
+		{"/api/v1/orgs", "", "", false},
+		{"/api/v1/orgs/myorg/apps", "myorg", "", false},
+		{"/api/v1/orgs/myorg/apps/web/versions", "myorg", "web", false},
+		{"/api/v1/orgs/my%2Forg/apps/web/versions", "my/org", "web", false},
+		{"/api/v1/orgs/myorg/apps/web%2Fadmin/versions", "myorg", "web/admin", false},
+		{"/api/v1/orgs/myorg/apps/web/tests/suite%2Fname", "myorg", "web", false},
+		{"/", "", "", true},
+		{"/myorg/", "myorg", "", true},
+		{"/myorg/web/1.0.0/junit.xml", "myorg", "web", false},
+	} {
+		org, app, listing := requestedApp(httptest.NewRequest(http.MethodGet, test.path, nil))
+		if org != test.org || app != test.app || listing != test.listing {
+			t.Errorf("%s: got %q %q %v, expected %q %q %v", test.path, org, app, listing, test.org, test.app,
+				test.listing)
+		}
+	}
+}
+
+func TestAuthorizeMetrics(t *testing.T) {
+	flagReadAuth = true
+	cachedReadAccess = &readAccess{
+		config: &readAccessConfig{Teams: map[string][]string{"platform": {"*"}, "frontend": {"myorg/*"}}},
+		users: []jenkinsxv1.User{
+			{ObjectMeta: metav1.ObjectMeta{Name: "prometheus"}, Spec: jenkinsxv1.UserDetails{ServiceAccount: "prometheus"}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "web-bot"}, Spec: jenkinsxv1.UserDetails{ServiceAccount: "web-bot"}},
+		},
+		teams: []jenkinsxv1.Team{
+			{ObjectMeta: metav1.ObjectMeta{Name: "platform"}, Spec: jenkinsxv1.TeamSpec{Members: []string{"prometheus"}}},
+			{ObjectMeta: metav1.ObjectMeta{Name: "frontend"}, Spec: jenkinsxv1.TeamSpec{Members: []string{"web-bot"}}},
+		},
+		loaded: time.Now(),
+	}
+	expires := time.Now().Add(time.Minute)
+	reviewedTokens[sha256.Sum256([]byte("prometheus-token"))] = reviewedToken{
+		username: "system:serviceaccount:" + cmNamespace + ":prometheus", expires: expires}
+	reviewedTokens[sha256.Sum256([]byte("impostor-token"))] = reviewedToken{
+		username: "system:serviceaccount:monitoring:prometheus", expires: expires}
+	reviewedTokens[sha256.Sum256([]byte("web-bot-token"))] = reviewedToken{
+		username: "system:serviceaccount:jx:web-bot", expires: expires}
+	defer func() {
+		flagReadAuth, cachedReadAccess = false, nil
+		reviewedTokens = map[[sha256.Size]byte]reviewedToken{}
+	}()
+	for _, test := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"prometheus-token", http.StatusOK},
+		{"web-bot-token", http.StatusForbidden},
+		{"impostor-token", http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		if test.token != "" {
+			r.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		w := httptest.NewRecorder()
+		authorizeMetrics(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})(w, r)
+		if w.Code != test.status {
+			t.Errorf("token %q: expected status %d, got %d", test.token, test.status, w.Code)
+		}
+	}
+}
+
+func TestReadAccessUser(t *testing.T) {
+	access := &readAccess{users: []jenkinsxv1.User{
+		{ObjectMeta: metav1.ObjectMeta{Name: "prometheus"}, Spec: jenkinsxv1.UserDetails{ServiceAccount: "prometheus"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "bot", Namespace: "jx-frontend"},
+			Spec: jenkinsxv1.UserDetails{ServiceAccount: "bot"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "jdoe"},
+			Spec: jenkinsxv1.UserDetails{Login: "jdoe-gh", Email: "jdoe@example.com"}},
+	}}
+	for name, user := range map[string]string{
+		"system:serviceaccount:" + cmNamespace + ":prometheus": "prometheus",
+		"system:serviceaccount:monitoring:prometheus":          "",
+		"system:serviceaccount:jx-frontend:bot":                "bot",
+		"system:serviceaccount:" + cmNamespace + ":bot":        "",
+		"system:serviceaccount:jx-frontend:jdoe-gh":            "",
+		"jdoe-gh":          "jdoe",
+		"jdoe@example.com": "jdoe",
+		"jdoe":             "jdoe",
+		"prometheus":       "prometheus",
+		"someone":          "",
+	} {
+		actual := ""
+		if u := access.user(name); u != nil {
+			actual = u.Name
+		}
+		if actual != user {
+			t.Errorf("expected %s to be the User %q, got %q", name, user, actual)
+		}
+	}
+}
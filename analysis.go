@@ -0,0 +1,175 @@
+package main
+
+import (
+	json2 "encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	contentTypeJUnit     = "text/vnd.junit-xml"
+	contentTypeCobertura = "text/vnd.cobertura-xml"
+	contentTypeJaCoCo    = "text/vnd.jacoco-xml"
+	contentTypeSARIF     = "application/sarif+json"
+)
+
+const (
+	severityCritical = "critical"
+	severityMajor    = "major"
+	severityMinor    = "minor"
+)
+
+// coverageResult is the line coverage of a coverage report
+type coverageResult struct {
+	Lines   int     `json:"lines,omitempty"`
+	Covered int     `json:"covered,omitempty"`
+	Percent float64 `json:"percent"`
+}
+
+// coberturaReport is the root element of a Cobertura coverage report
+type coberturaReport struct {
+	LineRate     string `xml:"line-rate,attr"`
+	LinesValid   string `xml:"lines-valid,attr"`
+	LinesCovered string `xml:"lines-covered,attr"`
+}
+
+// jacocoReport is the root element of a JaCoCo coverage report, only the report wide counters are needed
+type jacocoReport struct {
+	Counters []struct {
+		Type    string `xml:"type,attr"`
+		Missed  int    `xml:"missed,attr"`
+		Covered int    `xml:"covered,attr"`
+	} `xml:"counter"`
+}
+
+// sarifLog is the subset of a SARIF log needed to count and index findings
+type sarifLog struct {
+	Runs []struct {
+		Results []sarifResult `json:"results"`
+	} `json:"runs"`
+}
+
+type sarifResult struct {
+	RuleID  string `json:"ruleId"`
+	Level   string `json:"level"`
+	Message struct {
+		Text string `json:"text"`
+	} `json:"message"`
+	Locations []struct {
+		PhysicalLocation struct {
+			ArtifactLocation struct {
+				URI string `json:"uri"`
+			} `json:"artifactLocation"`
+			Region struct {
+				StartLine int `json:"startLine"`
+			} `json:"region"`
+		} `json:"physicalLocation"`
+	} `json:"locations"`
+}
+
+func parseCobertura(data []byte) (*coverageResult, error) {
+	var report coberturaReport
+	if err := xml.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	lines, _ := strconv.Atoi(report.LinesValid)
+	covered, _ := strconv.Atoi(report.LinesCovered)
+	if lines > 0 {
+		return &coverageResult{Lines: lines, Covered: covered, Percent: 100 * float64(covered) / float64(lines)}, nil
+	}
+	if report.LineRate == "" {
+		return nil, errors.New("no line-rate in Cobertura report")
+	}
+	return &coverageResult{Percent: 100 * parseJUnitFloat(report.LineRate)}, nil
+}
+
+func parseJaCoCo(data []byte) (*coverageResult, error) {
+	var report jacocoReport
+	if err := xml.Unmarshal(data, &report); err != nil {
+		return nil, err
+	}
+	for _, c := range report.Counters {
+		if c.Type == "LINE" {
+			lines := c.Missed + c.Covered
+			if lines == 0 {
+				return &coverageResult{}, nil
+			}
+			return &coverageResult{Lines: lines, Covered: c.Covered, Percent: 100 * float64(c.Covered) / float64(lines)}, nil
+		}
+	}
+	return nil, errors.New("no LINE counter in JaCoCo report")
+}
+
+// parseSARIF counts the results of a SARIF log by severity
+func parseSARIF(data []byte) (map[string]int, error) {
+	results, err := parseSARIFResults(data)
+	if err != nil {
+		return nil, err
+	}
+	findings := map[string]int{}
+	for _, result := range results {
+		findings[result.severity()]++
+	}
+	return findings, nil
+}
+
+func parseSARIFResults(data []byte) ([]sarifResult, error) {
+	var log sarifLog
+	if err := json2.Unmarshal(data, &log); err != nil {
+		return nil, err
+	}
+	var results []sarifResult
+	for _, run := range log.Runs {
+		results = append(results, run.Results...)
+	}
+	return results, nil
+}
+
+// severity maps the level of a result to a severity, errors are critical, warnings major and everything else
+// minor. A result without a level is a warning according to the SARIF specification.
+func (result *sarifResult) severity() string {
+	switch result.Level {
+	case "error":
+		return severityCritical
+	case "warning", "":
+		return severityMajor
+	}
+	return severityMinor
+}
+
+// location is the file and line of the first location of the result
+func (result *sarifResult) location() string {
+	if len(result.Locations) == 0 {
+		return ""
+	}
+	l := result.Locations[0].PhysicalLocation
+	if l.Region.StartLine > 0 {
+		return fmt.Sprintf("%s:%d", l.ArtifactLocation.URI, l.Region.StartLine)
+	}
+	return l.ArtifactLocation.URI
+}
+
+// analyseReport extracts the results of the recognised report types into the build report
+func analyseReport(report *buildReport, data []byte) error {
+	var err error
+	switch report.ContentType {
+	case contentTypeJUnit:
+		var suites []junitTestSuite
+		suites, err = parseJUnit(data)
+		if err == nil {
+			report.addTests(suites)
+		}
+	case contentTypeCobertura:
+		report.Coverage, err = parseCobertura(data)
+	case contentTypeJaCoCo:
+		report.Coverage, err = parseJaCoCo(data)
+	case contentTypeSARIF:
+		report.Findings, err = parseSARIF(data)
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid %s report %s: %s", report.ContentType, report.Name, err))
+	}
+	return nil
+}
@@ -0,0 +1,461 @@
+package main
+
+import (
+	"crypto/sha256"
+	json2 "encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	neturl "net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const apiPrefix = "/api/v1/"
+
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+// apiHandler serves the read-only JSON API on the download server
+func apiHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			renderJSONError(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+			return
+		}
+		parts, err := splitEscapedPath(strings.TrimPrefix(r.URL.EscapedPath(), apiPrefix))
+		if err != nil {
+			renderJSONError(w, "INVALID_PATH", http.StatusBadRequest)
+			return
+		}
+		// org and app names are storage paths, they can't be escaped to reach somewhere else
+		if len(parts) >= 2 && parts[0] == "orgs" && !validName(parts[1]) ||
+			len(parts) >= 4 && parts[0] == "orgs" && parts[2] == "apps" && !validName(parts[3]) {
+			renderJSONError(w, "INVALID_NAME", http.StatusBadRequest)
+			return
+		}
+		switch {
+		case len(parts) == 1 && parts[0] == "orgs":
+			orgs, err := listOrgs()
+			if err != nil {
+				renderJSONError(w, "CANT_READ_MANIFEST", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			renderPage(w, r, requestReader(r).visibleOrgs(orgs))
+		case len(parts) == 3 && parts[0] == "orgs" && parts[2] == "apps":
+			apps, err := listApps(parts[1])
+			if err != nil {
+				renderJSONError(w, "CANT_READ_MANIFEST", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+			renderPage(w, r, requestReader(r).visibleApps(parts[1], apps))
+		case len(parts) == 1 && parts[0] == "attestation-key":
+			signingKeyHandler(w, r)
+		case len(parts) == 3 && parts[0] == "orgs" && parts[2] == "quota":
+			quotaHandler(w, r, parts[1], "")
+		case len(parts) >= 5 && parts[0] == "orgs" && parts[2] == "apps":
+			appAPIHandler(w, r, parts[1], parts[3], parts[4:])
+		default:
+			renderJSONError(w, "NOT_FOUND", http.StatusNotFound)
+		}
+	})
+}
+
+// appAPIHandler serves everything below /api/v1/orgs/{org}/apps/{app}/
+func appAPIHandler(w http.ResponseWriter, r *http.Request, org string, app string, parts []string) {
+	switch {
+	case len(parts) == 1 && parts[0] == "flaky-tests":
+		flakyTestsHandler(w, r, org, app)
+	case len(parts) == 1 && parts[0] == "slow-tests":
+		durationTrendsHandler(w, r, org, app, (*testHistory).slowestTests, slowerMedian)
+	case len(parts) == 1 && parts[0] == "regressed-tests":
+		durationTrendsHandler(w, r, org, app, (*testHistory).regressedTests, largerChange)
+	case len(parts) == 1 && parts[0] == "search":
+		searchHandler(w, r, org, app)
+	case len(parts) == 1 && parts[0] == "trends":
+		trendsHandler(w, r, org, app)
+	case len(parts) == 1 && parts[0] == "quota":
+		quotaHandler(w, r, org, app)
+	case len(parts) == 1 && parts[0] == "integrity":
+		integrityHandler(w, r, org, app)
+	case len(parts) == 1 && parts[0] == "environments":
+		environmentsHandler(w, r, org, app)
+	case len(parts) == 2 && parts[0] == "tests":
+		testHistoryHandler(w, r, org, app, parts[1])
+	case len(parts) == 1 && parts[0] == "manifest", parts[0] == "versions":
+		m, err := loadAppManifest(org, app)
+		if err != nil {
+			renderJSONError(w, "CANT_READ_MANIFEST", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if len(m.Versions) == 0 {
+			renderJSONError(w, "NOT_FOUND", http.StatusNotFound)
+			return
+		}
+		manifestAPIHandler(w, r, m, parts)
+	default:
+		renderJSONError(w, "NOT_FOUND", http.StatusNotFound)
+	}
+}
+
+// manifestAPIHandler serves the manifest of an app and the versions and builds listed in it
+func manifestAPIHandler(w http.ResponseWriter, r *http.Request, m *appManifest, parts []string) {
+	if len(parts) == 1 && parts[0] == "manifest" {
+		renderAPI(w, r, m)
+		return
+	}
+	if len(parts) == 1 {
+		renderPage(w, r, m.sortedVersions())
+		return
+	}
+	v := m.Versions[parts[1]]
+	if v == nil {
+		renderJSONError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	switch {
+	case len(parts) == 2:
+		renderAPI(w, r, v)
+	case len(parts) == 3 && parts[2] == "builds":
+		renderPage(w, r, v.sortedBuilds())
+	case len(parts) == 3 && parts[2] == "attestation":
+		attestationHandler(w, r, m, v, nil)
+	case len(parts) == 3 && parts[2] == "promotion":
+		promotionHandler(w, r, m, v)
+	case len(parts) >= 4 && parts[2] == "builds":
+		entry := v.Builds[parts[3]]
+		if entry == nil {
+			renderJSONError(w, "NOT_FOUND", http.StatusNotFound)
+			return
+		}
+		b, err := loadBuildRecord(m.Org, m.App, entry.Branch, entry.Build)
+		if err != nil {
+			renderJSONError(w, "CANT_READ_BUILD", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		switch {
+		case len(parts) == 4:
+			buildSummaryHandler(w, r, b)
+		case len(parts) == 5 && parts[4] == "tests":
+			buildTestsHandler(w, r, b)
+		case len(parts) == 5 && parts[4] == "attestation":
+			attestationHandler(w, r, m, v, entry)
+		default:
+			renderJSONError(w, "NOT_FOUND", http.StatusNotFound)
+		}
+	default:
+		renderJSONError(w, "NOT_FOUND", http.StatusNotFound)
+	}
+}
+
+// buildSummaryHandler returns the summary of a finalized build, or what it would be if the build were finalized now
+func buildSummaryHandler(w http.ResponseWriter, r *http.Request, b *buildRecord) {
+	if b.Summary != nil {
+		renderAPI(w, r, b.Summary)
+		return
+	}
+	renderAPI(w, r, b.summarize(b.Verdict, nil))
+}
+
+// apiTestCase is a test case of a build as returned by the API
+type apiTestCase struct {
+	Report    string  `json:"report"`
+	Suite     string  `json:"suite"`
+	Name      string  `json:"name"`
+	Classname string  `json:"classname,omitempty"`
+	Status    string  `json:"status"`
+	Time      float64 `json:"time"`
+	Message   string  `json:"message,omitempty"`
+}
+
+// buildTestsHandler lists the test cases of every JUnit report of a build, filtered by the status query parameter
+// the same way the HTML report is
+func buildTestsHandler(w http.ResponseWriter, r *http.Request, b *buildRecord) {
+	filter := r.URL.Query().Get("status")
+	tests := []apiTestCase{}
+	for _, report := range b.sortedReports() {
+		if report.ContentType != contentTypeJUnit {
+			continue
+		}
+		data, err := readStoredFile(filepath.Join(appUploadPath(b.Org, b.App), b.Org, b.App, b.Version, report.Name))
+		if err != nil {
+			renderJSONError(w, "CANT_READ_FILE", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		suites, err := parseJUnit(data)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, s := range suites {
+			for _, tc := range s.TestCases {
+				status := tc.Status()
+				if !matchesStatusFilter(status, filter) {
+					continue
+				}
+				test := apiTestCase{
+					Report:    report.Name,
+					Suite:     s.Name,
+					Name:      tc.Name,
+					Classname: tc.Classname,
+					Status:    status,
+					Time:      tc.Duration(),
+				}
+				for _, result := range []*junitResult{tc.Failure, tc.Error, tc.Skipped} {
+					if result != nil {
+						test.Message = result.Message
+					}
+				}
+				tests = append(tests, test)
+			}
+		}
+	}
+	renderPage(w, r, tests)
+}
+
+// requestIndexQuery reads the documents to select from the kind, version, branch, build, status and q query
+// parameters
+func requestIndexQuery(r *http.Request) indexQuery {
+	query := r.URL.Query()
+	return indexQuery{
+		Kind:    query.Get("kind"),
+		Version: query.Get("version"),
+		Branch:  query.Get("branch"),
+		Build:   query.Get("build"),
+		Status:  query.Get("status"),
+		Text:    query.Get("q"),
+	}
+}
+
+// searchHandler lists the indexed suites, test cases, coverage results and findings of an app
+func searchHandler(w http.ResponseWriter, r *http.Request, org string, app string) {
+	docs, err := queryIndex(org, app, requestIndexQuery(r))
+	if err != nil {
+		renderJSONError(w, "CANT_READ_INDEX", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	renderPage(w, r, docs)
+}
+
+// trendsHandler lists the tests, coverage and findings of every indexed build of an app, oldest first
+func trendsHandler(w http.ResponseWriter, r *http.Request, org string, app string) {
+	q := requestIndexQuery(r)
+	q.Kind, q.Status, q.Text = "", "", ""
+	docs, err := queryIndex(org, app, q)
+	if err != nil {
+		renderJSONError(w, "CANT_READ_INDEX", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	renderPage(w, r, indexTrends(docs))
+}
+
+// testHistoryHandler returns the recorded outcomes of a single test, for every branch or the one given by the
+// branch query parameter
+func testHistoryHandler(w http.ResponseWriter, r *http.Request, org string, app string, name string) {
+	histories, err := requestTestHistories(r, org, app)
+	if err != nil {
+		renderJSONError(w, "CANT_READ_TEST_HISTORY", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	branches := map[string][]testOutcome{}
+	for _, h := range histories {
+		if outcomes, ok := h.Tests[name]; ok {
+			branches[h.Branch] = outcomes
+		}
+	}
+	if len(branches) == 0 {
+		renderJSONError(w, "NOT_FOUND", http.StatusNotFound)
+		return
+	}
+	renderAPI(w, r, map[string]interface{}{
+		"org":      org,
+		"app":      app,
+		"name":     name,
+		"branches": branches,
+	})
+}
+
+// requestTestHistories loads the test history of the branch given by the branch query parameter, or of all
+// branches if there is none
+func requestTestHistories(r *http.Request, org string, app string) ([]*testHistory, error) {
+	if branch := r.URL.Query().Get("branch"); branch != "" {
+		h, err := loadTestHistory(org, app, branch)
+		if err != nil {
+			return nil, err
+		}
+		return []*testHistory{h}, nil
+	}
+	return loadAppTestHistories(org, app)
+}
+
+// requestLimit returns the limit query parameter, or def if there is none
+func requestLimit(r *http.Request, def int) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return def
+	}
+	return limit
+}
+
+// flakyTestsHandler reports the flaky tests of an app, optionally restricted to a single branch
+func flakyTestsHandler(w http.ResponseWriter, r *http.Request, org string, app string) {
+	histories, err := requestTestHistories(r, org, app)
+	if err != nil {
+		renderJSONError(w, "CANT_READ_TEST_HISTORY", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	tests := []flakyTest{}
+	for _, h := range histories {
+		tests = append(tests, h.flakyTests()...)
+	}
+	sortFlakyTests(tests)
+	renderAPI(w, r, map[string]interface{}{
+		"org":   org,
+		"app":   app,
+		"tests": tests,
+	})
+}
+
+// durationTrendsHandler reports the tests of an app selected by trends, e.g. the slowest or most regressed ones
+func durationTrendsHandler(w http.ResponseWriter, r *http.Request, org string, app string, trends func(*testHistory) []durationTrend, less func(durationTrend, durationTrend) bool) {
+	histories, err := requestTestHistories(r, org, app)
+	if err != nil {
+		renderJSONError(w, "CANT_READ_TEST_HISTORY", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	tests := []durationTrend{}
+	for _, h := range histories {
+		tests = append(tests, trends(h)...)
+	}
+	sortDurationTrends(tests, less)
+	if limit := requestLimit(r, 20); len(tests) > limit {
+		tests = tests[:limit]
+	}
+	renderAPI(w, r, map[string]interface{}{
+		"org":   org,
+		"app":   app,
+		"tests": tests,
+	})
+}
+
+// apiPage is the envelope of paginated API responses
+type apiPage struct {
+	Items   interface{} `json:"items"`
+	Page    int         `json:"page"`
+	PerPage int         `json:"perPage"`
+	Total   int         `json:"total"`
+}
+
+// renderPage renders the page of items selected by the page and perPage query parameters, items has to be a slice
+func renderPage(w http.ResponseWriter, r *http.Request, items interface{}) {
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	perPage, err := strconv.Atoi(r.URL.Query().Get("perPage"))
+	if err != nil || perPage < 1 {
+		perPage = defaultPerPage
+	}
+	if perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+	all := reflect.ValueOf(items)
+	total := all.Len()
+	// pages past the last are empty, clamping them to the one after it keeps a huge page from overflowing the start
+	if past := (total+perPage-1)/perPage + 1; page > past {
+		page = past
+	}
+	start := (page - 1) * perPage
+	if start > total {
+		start = total
+	}
+	end := start + perPage
+	if end > total {
+		end = total
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	renderAPI(w, r, apiPage{
+		Items:   all.Slice(start, end).Interface(),
+		Page:    page,
+		PerPage: perPage,
+		Total:   total,
+	})
+}
+
+// renderAPI renders v with an ETag, answering 304 Not Modified if the client already has the same response
+func renderAPI(w http.ResponseWriter, r *http.Request, v interface{}) {
+	data, err := json2.MarshalIndent(v, "", "  ")
+	if err != nil {
+		renderJSONError(w, "CANT_ENCODE_RESPONSE", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	etag := fmt.Sprintf("\"%x\"", sha256.Sum256(data))
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "no-cache")
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if match = strings.TrimSpace(match); match == etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// splitEscapedPath splits an escaped URL path into its unescaped segments, so that segments such as test names can
+// contain an escaped '/'
+func splitEscapedPath(path string) ([]string, error) {
+	var parts []string
+	for _, p := range splitPath(path) {
+		part, err := neturl.PathUnescape(p)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, part)
+	}
+	return parts, nil
+}
+
+func splitPath(path string) []string {
+	var parts []string
+	for _, p := range strings.Split(path, "/") {
+		if p != "" {
+			parts = append(parts, p)
+		}
+	}
+	return parts
+}
+
+func renderJSON(w http.ResponseWriter, v interface{}, statusCode int) {
+	data, err := json2.MarshalIndent(v, "", "  ")
+	if err != nil {
+		renderJSONError(w, "CANT_ENCODE_RESPONSE", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(data)
+}
+
+func renderJSONError(w http.ResponseWriter, message string, statusCode int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	data, _ := json2.Marshal(map[string]string{"error": message})
+	w.Write(data)
+}
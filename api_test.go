@@ -0,0 +1,46 @@
+package main
+
+import (
+	json2 "encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func TestRenderPage(t *testing.T) {
+	items := []string{"a", "b", "c", "d", "e"}
+	for _, test := range []struct {
+		query   string
+		page    int
+		perPage int
+		items   []string
+	}{
+		{"", 1, defaultPerPage, items},
+		{"?page=2&perPage=2", 2, 2, []string{"c", "d"}},
+		{"?page=3&perPage=2", 3, 2, []string{"e"}},
+		{"?page=4&perPage=2", 4, 2, []string{}},
+		{"?page=0&perPage=0", 1, defaultPerPage, items},
+		{"?page=2&perPage=5", 2, 5, []string{}},
+		{"?page=9223372036854775807&perPage=2", 4, 2, []string{}},
+		{"?page=9223372036854775807&perPage=" + strconv.Itoa(maxPerPage), 2, maxPerPage, []string{}},
+	} {
+		w := httptest.NewRecorder()
+		renderPage(w, httptest.NewRequest(http.MethodGet, "/api/v1/orgs"+test.query, nil), items)
+		var page struct {
+			Items   []string `json:"items"`
+			Page    int      `json:"page"`
+			PerPage int      `json:"perPage"`
+			Total   int      `json:"total"`
+		}
+		err := json2.Unmarshal(w.Body.Bytes(), &page)
+		if err != nil {
+			t.Fatalf("%s: %s", test.query, err)
+		}
+		if page.Page != test.page || page.PerPage != test.perPage || page.Total != len(items) ||
+			!reflect.DeepEqual(page.Items, test.items) {
+			t.Errorf("%s: unexpected page %+v", test.query, page)
+		}
+	}
+}
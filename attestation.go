@@ -0,0 +1,428 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	json2 "encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	"io/ioutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const signingKeySecret = "jenkins-x-reports-signing-key"
+const signingKeyKey = "signing.key"
+
+// attestationPayloadType identifies the payload of the envelopes attestations are signed in
+const attestationPayloadType = "application/vnd.jenkins-x-reports.attestation+json"
+
+// attestation states which reports were stored for a build, or for every build of a released version, and what
+// they found. It is signed as a DSSE envelope, see https://github.com/secure-systems-lab/dsse.
+type attestation struct {
+	Org     string           `json:"org"`
+	App     string           `json:"app"`
+	Version string           `json:"version"`
+	Release *attestedRelease `json:"release,omitempty"`
+	Builds  []*attestedBuild `json:"builds"`
+	Issued  time.Time        `json:"issued"`
+}
+
+// attestedRelease is the jenkins.io/v1 Release of the version attested
+type attestedRelease struct {
+	Name       string   `json:"name"`
+	Namespace  string   `json:"namespace"`
+	GitHTTPURL string   `json:"gitHttpUrl,omitempty"`
+	Commits    []string `json:"commits,omitempty"`
+}
+
+// attestedBuild is a build with the hashes of its report files and its summary
+type attestedBuild struct {
+	Branch    string         `json:"branch"`
+	Build     string         `json:"build"`
+	CommitSHA string         `json:"commitSha,omitempty"`
+	Summary   *buildSummary  `json:"summary"`
+	Files     []attestedFile `json:"files"`
+	// Superseded are the files of the build a later build uploaded again, which are attested with that build
+	Superseded []string `json:"superseded,omitempty"`
+}
+
+// attestedFile is a report file as it is stored and served
+type attestedFile struct {
+	Name   string `json:"name"`
+	SHA256 string `json:"sha256"`
+	Size   int    `json:"size"`
+}
+
+// signedEnvelope is a DSSE envelope, the payload is the attestation as JSON
+type signedEnvelope struct {
+	PayloadType string              `json:"payloadType"`
+	Payload     string              `json:"payload"`
+	Signatures  []envelopeSignature `json:"signatures"`
+}
+
+type envelopeSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+var signingKeyLock sync.Mutex
+var signingKey ed25519.PrivateKey
+var signingKeyLoaded time.Time
+
+// errNoSigningKey is returned when there is no key to sign attestations with
+var errNoSigningKey = errors.New(fmt.Sprintf("no %s in Secret %s", signingKeyKey, signingKeySecret))
+
+// loadSigningKey reads the ed25519 key attestations are signed with from the signing.key key of the
+// jenkins-x-reports-signing-key Secret, as a PKCS#8 PEM block such as openssl genpkey -algorithm ed25519 writes
+func loadSigningKey() (ed25519.PrivateKey, error) {
+	signingKeyLock.Lock()
+	defer signingKeyLock.Unlock()
+	if signingKey != nil && time.Since(signingKeyLoaded) < authCacheTTL {
+		return signingKey, nil
+	}
+	secret, err := kubernetesClient.CoreV1().Secrets(cmNamespace).Get(signingKeySecret, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, errNoSigningKey
+	}
+	if err != nil {
+		return nil, observeKubernetes("get_secret", err)
+	}
+	data, ok := secret.Data[signingKeyKey]
+	if !ok {
+		return nil, errNoSigningKey
+	}
+	key, err := parsePrivateKey(data)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid %s in Secret %s: %s", signingKeyKey, signingKeySecret, err))
+	}
+	signingKey = key
+	signingKeyLoaded = time.Now()
+	return key, nil
+}
+
+func parsePrivateKey(data []byte) (ed25519.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not a PEM block")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%T is not an ed25519 key", key))
+	}
+	return private, nil
+}
+
+// parsePublicKey reads an ed25519 public key from a PKIX PEM block such as openssl pkey -pubout writes
+func parsePublicKey(data []byte) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("not a PEM block")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%T is not an ed25519 key", key))
+	}
+	return public, nil
+}
+
+// keyID identifies a public key by the start of the SHA-256 of its bytes
+func keyID(key ed25519.PublicKey) string {
+	return fmt.Sprintf("%x", sha256.Sum256(key))[:16]
+}
+
+// preAuthEncoding is what DSSE signs, binding the payload to its type
+func preAuthEncoding(payloadType string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload))
+}
+
+// sign signs an attestation with the key from the Secret
+func (a *attestation) sign() (*signedEnvelope, error) {
+	key, err := loadSigningKey()
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json2.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := key.Sign(nil, preAuthEncoding(attestationPayloadType, payload), crypto.Hash(0))
+	if err != nil {
+		return nil, err
+	}
+	return &signedEnvelope{
+		PayloadType: attestationPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures: []envelopeSignature{{
+			KeyID: keyID(key.Public().(ed25519.PublicKey)),
+			Sig:   base64.StdEncoding.EncodeToString(sig),
+		}},
+	}, nil
+}
+
+// verify checks the envelope was signed with key and returns the attestation in it
+func (e *signedEnvelope) verify(key ed25519.PublicKey) (*attestation, error) {
+	if e.PayloadType != attestationPayloadType {
+		return nil, errors.New(fmt.Sprintf("unexpected payload type %s", e.PayloadType))
+	}
+	payload, err := base64.StdEncoding.DecodeString(e.Payload)
+	if err != nil {
+		return nil, err
+	}
+	verified := false
+	for _, s := range e.Signatures {
+		sig, err := base64.StdEncoding.DecodeString(s.Sig)
+		if err == nil && ed25519.Verify(key, preAuthEncoding(e.PayloadType, payload), sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, errors.New(fmt.Sprintf("no signature by key %s", keyID(key)))
+	}
+	a := &attestation{}
+	err = json2.Unmarshal(payload, a)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// errReportChanged is returned when a stored report file isn't the one a build uploaded any more, because it was
+// changed in storage, so the build can't be attested
+type errReportChanged struct {
+	file     string
+	expected string
+	actual   string
+}
+
+func (e *errReportChanged) Error() string {
+	return fmt.Sprintf("%s was uploaded with SHA-256 %s but is %s now", e.file, e.expected, e.actual)
+}
+
+// attestFile hashes a stored report file, checking it against the checksum the build recorded for it and the one
+// the version recorded when it was last uploaded
+func attestFile(report *buildReport, checksum *reportChecksum, data []byte) (attestedFile, error) {
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	for _, expected := range []string{report.SHA256, checksum.sha256()} {
+		if expected != "" && expected != sum {
+			return attestedFile{}, &errReportChanged{file: report.Name, expected: expected, actual: sum}
+		}
+	}
+	return attestedFile{Name: report.Name, SHA256: sum, Size: len(data)}, nil
+}
+
+// attestBuilds builds the attestation of some builds of a version, hashing their report files as they are stored.
+// A file that no longer matches the checksum recorded when it was last uploaded can't be attested.
+func attestBuilds(org string, app string, v *versionManifest, entries []*buildManifest) (*attestation, error) {
+	a := &attestation{Org: org, App: app, Version: v.Version, Builds: []*attestedBuild{}, Issued: time.Now().UTC()}
+	dir := filepath.Join(appUploadPath(org, app), org, app, v.Version)
+	for _, entry := range entries {
+		b, err := loadBuildRecord(org, app, entry.Branch, entry.Build)
+		if err != nil {
+			return nil, err
+		}
+		ab := &attestedBuild{Branch: b.Branch, Build: b.Build, Summary: b.Summary}
+		if ab.Summary == nil {
+			ab.Summary = b.summarize(b.Verdict, nil)
+		}
+		if b.Activity != nil {
+			ab.CommitSHA = b.Activity.LastCommitSHA
+		}
+		ab.Files, ab.Superseded, err = attestReports(dir, b.sortedReports(), v.Checksums)
+		if err != nil {
+			return nil, err
+		}
+		a.Builds = append(a.Builds, ab)
+	}
+	return a, nil
+}
+
+// attestReports hashes the stored report files of a build. The files a later build of the version uploaded again
+// are stored as that build uploaded them, so they are returned as superseded rather than attested.
+func attestReports(dir string, reports []*buildReport, checksums map[string]*reportChecksum) ([]attestedFile,
+	[]string, error) {
+	files, superseded := []attestedFile{}, []string(nil)
+	for _, report := range reports {
+		checksum := checksums[report.Name]
+		if checksum.supersedes(report) {
+			superseded = append(superseded, report.Name)
+			continue
+		}
+		data, err := readStoredFile(filepath.Join(dir, report.Name))
+		if err != nil {
+			return nil, nil, err
+		}
+		file, err := attestFile(report, checksum, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, file)
+	}
+	return files, superseded, nil
+}
+
+// findRelease returns the Release made of a version of an app, if there is one
+func findRelease(releases []jenkinsxv1.Release, org string, app string, version string) *jenkinsxv1.Release {
+	for i, r := range releases {
+		if r.Spec.GitOwner != "" && r.Spec.GitOwner != org {
+			continue
+		}
+		if r.Spec.GitRepository != app && r.Spec.Name != app {
+			continue
+		}
+		if trimVersion(r.Spec.Version) == trimVersion(version) {
+			return &releases[i]
+		}
+	}
+	return nil
+}
+
+// trimVersion drops the v some versions are tagged with
+func trimVersion(version string) string {
+	return strings.TrimPrefix(version, "v")
+}
+
+// attestRelease builds the attestation of every build of a version, along with the Release made of it
+func attestRelease(org string, app string, v *versionManifest) (*attestation, error) {
+	list, err := jenkinsClient.JenkinsV1().Releases(appNamespace(org, app)).List(metav1.ListOptions{})
+	if err = observeKubernetes("list_releases", err); err != nil {
+		return nil, err
+	}
+	a, err := attestBuilds(org, app, v, v.sortedBuilds())
+	if err != nil {
+		return nil, err
+	}
+	if release := findRelease(list.Items, org, app, v.Version); release != nil {
+		a.Release = &attestedRelease{Name: release.Name, Namespace: release.Namespace,
+			GitHTTPURL: release.Spec.GitHTTPURL}
+		for _, c := range release.Spec.Commits {
+			a.Release.Commits = append(a.Release.Commits, c.SHA)
+		}
+	}
+	return a, nil
+}
+
+// attestationHandler serves the signed attestation of a build, or of every build of a version if entry is nil, as
+// a file to download
+func attestationHandler(w http.ResponseWriter, r *http.Request, m *appManifest, v *versionManifest, entry *buildManifest) {
+	var a *attestation
+	var err error
+	name := fmt.Sprintf("%s-%s", m.App, v.Version)
+	if entry == nil {
+		a, err = attestRelease(m.Org, m.App, v)
+	} else {
+		name = fmt.Sprintf("%s-%s", name, buildKey(entry.Branch, entry.Build))
+		a, err = attestBuilds(m.Org, m.App, v, []*buildManifest{entry})
+	}
+	if _, ok := err.(*errReportChanged); ok {
+		renderJSONError(w, "REPORT_CHANGED", http.StatusConflict)
+		log.Println(err)
+		return
+	}
+	if err != nil {
+		renderJSONError(w, "CANT_ATTEST", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	envelope, err := a.sign()
+	if err == errNoSigningKey {
+		renderJSONError(w, "NO_SIGNING_KEY", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		renderJSONError(w, "CANT_SIGN", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.attestation.json"`, name))
+	renderAPI(w, r, envelope)
+}
+
+// signingKeyHandler serves the public key attestations can be verified with, as a PKIX PEM block
+func signingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	key, err := loadSigningKey()
+	if err == errNoSigningKey {
+		renderJSONError(w, "NO_SIGNING_KEY", http.StatusNotFound)
+		return
+	}
+	var der []byte
+	if err == nil {
+		der, err = x509.MarshalPKIXPublicKey(key.Public())
+	}
+	if err != nil {
+		renderJSONError(w, "CANT_READ_SIGNING_KEY", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// verifyAttestationFile checks an attestation downloaded from the service against the public key, without access to
+// the cluster. If dir isn't empty the report files in it, laid out as they are downloaded, are hashed as well.
+func verifyAttestationFile(path string, publicKeyPath string, dir string) (*attestation, error) {
+	data, err := ioutil.ReadFile(publicKeyPath)
+	if err != nil {
+		return nil, err
+	}
+	key, err := parsePublicKey(data)
+	if err != nil {
+		return nil, err
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	envelope := &signedEnvelope{}
+	err = json2.Unmarshal(data, envelope)
+	if err != nil {
+		return nil, err
+	}
+	a, err := envelope.verify(key)
+	if err != nil || dir == "" {
+		return a, err
+	}
+	var mismatches []string
+	for _, b := range a.Builds {
+		for _, f := range b.Files {
+			data, err := ioutil.ReadFile(filepath.Join(dir, f.Name))
+			if os.IsNotExist(err) {
+				mismatches = append(mismatches, f.Name+" is missing")
+				continue
+			}
+			if err != nil {
+				return a, err
+			}
+			if sum := sha256.Sum256(data); fmt.Sprintf("%x", sum) != f.SHA256 {
+				mismatches = append(mismatches, f.Name+" doesn't match")
+			}
+		}
+	}
+	if len(mismatches) > 0 {
+		sort.Strings(mismatches)
+		return a, errors.New(strings.Join(mismatches, ", "))
+	}
+	return a, nil
+}
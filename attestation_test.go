@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAttestFile(t *testing.T) {
+	data := []byte("<testsuite tests=\"1\"/>")
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	other := fmt.Sprintf("%x", sha256.Sum256([]byte("<testsuite tests=\"2\"/>")))
+	for _, test := range []struct {
+		name     string
+		build    string
+		checksum *reportChecksum
+		changed  bool
+	}{
+		{"nothing recorded", "", nil, false},
+		{"recorded by the build", sum, nil, false},
+		{"recorded by the build and the version", sum, &reportChecksum{SHA256: sum}, false},
+		{"recorded by the version only", "", &reportChecksum{SHA256: sum}, false},
+		{"uploaded again by another build", other, &reportChecksum{SHA256: sum}, true},
+		{"changed in storage", sum, &reportChecksum{SHA256: other}, true},
+		{"changed in storage without a checksum of the version", other, nil, true},
+	} {
+		report := &buildReport{Name: "junit.xml", SHA256: test.build}
+		file, err := attestFile(report, test.checksum, data)
+		if _, changed := err.(*errReportChanged); changed != test.changed {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !test.changed && (file.Name != "junit.xml" || file.SHA256 != sum || file.Size != len(data)) {
+			t.Errorf("%s: unexpected attested file %+v", test.name, file)
+		}
+	}
+}
+
+func TestAttestReportsOfBuildsUploadingTheSameFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	first, second := []byte("<testsuite tests=\"1\"/>"), []byte("<testsuite tests=\"2\"/>")
+	err = ioutil.WriteFile(filepath.Join(dir, "junit.xml"), second, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded := time.Now().UTC()
+	firstReport := &buildReport{Name: "junit.xml", Uploaded: uploaded.Add(-time.Minute),
+		SHA256: fmt.Sprintf("%x", sha256.Sum256(first))}
+	secondReport := &buildReport{Name: "junit.xml", Uploaded: uploaded, SHA256: fmt.Sprintf("%x", sha256.Sum256(second))}
+	checksums := map[string]*reportChecksum{"junit.xml": {SHA256: secondReport.SHA256, Uploaded: uploaded}}
+
+	files, superseded, err := attestReports(dir, []*buildReport{firstReport}, checksums)
+	if err != nil {
+		t.Fatalf("expected the first build to be attested, got %v", err)
+	}
+	if len(files) != 0 || !reflect.DeepEqual(superseded, []string{"junit.xml"}) {
+		t.Errorf("expected the file of the first build to be superseded, got %v and %v", files, superseded)
+	}
+	files, superseded, err = attestReports(dir, []*buildReport{secondReport}, checksums)
+	if err != nil {
+		t.Fatalf("expected the second build to be attested, got %v", err)
+	}
+	if len(files) != 1 || files[0].SHA256 != secondReport.SHA256 || superseded != nil {
+		t.Errorf("expected the file of the second build to be attested, got %v and %v", files, superseded)
+	}
+}
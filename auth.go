@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/ghodss/yaml"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flagUploadAuth requires uploads to authenticate with a bearer token
+var flagUploadAuth = os.Getenv("UPLOAD_AUTH") == "true"
+
+const uploadAuthSecret = "jenkins-x-reports-upload-auth"
+const uploadAuthKey = "auth.yaml"
+const authCacheTTL = time.Minute
+
+// uploadAuthConfig is read from the auth.yaml key of the jenkins-x-reports-upload-auth Secret, e.g.
+//
+//	tokens:
+//	- name: release-pipeline
+//	  token: 6f1c...
+//	  namespace: jx-frontend
+//	  allow: ["myorg/*"]
+//	serviceAccounts:
+//	- name: system:serviceaccount:jx:tekton-bot
+//	  allow: ["*"]
+//
+// allow lists org/app patterns, with * matching any org or app. The namespace of a token is the team it uploads for,
+// service accounts upload for the team of their own namespace.
+type uploadAuthConfig struct {
+	Tokens          []uploadIdentity `json:"tokens"`
+	ServiceAccounts []uploadIdentity `json:"serviceAccounts"`
+}
+
+// uploadIdentity is a static token or service account and the apps it may upload reports for
+type uploadIdentity struct {
+	Name      string   `json:"name"`
+	Token     string   `json:"token,omitempty"`
+	Namespace string   `json:"namespace,omitempty"`
+	Allow     []string `json:"allow"`
+}
+
+type identityKey struct{}
+
+var authLock sync.Mutex
+var authConfig *uploadAuthConfig
+var authConfigLoaded time.Time
+
+// reviewedTokens caches the users TokenReview authenticated, by the hash of their token
+var reviewedTokens = map[[sha256.Size]byte]reviewedToken{}
+
+type reviewedToken struct {
+	username string
+	expires  time.Time
+}
+
+// authenticateUploads only passes requests on to h if they authenticate with a token allowed to upload reports for
+// their org and app. Without UPLOAD_AUTH anyone can upload.
+func authenticateUploads(h http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !flagUploadAuth {
+			h(w, r)
+			return
+		}
+		token := strings.TrimSpace(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if token == "" || token == r.Header.Get("Authorization") {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="jenkins-x-reports"`)
+			renderError(w, "MUST_PROVIDE_BEARER_TOKEN", http.StatusUnauthorized)
+			return
+		}
+		identity, err := authenticate(token)
+		if err != nil {
+			renderError(w, "CANT_AUTHENTICATE", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if identity == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="jenkins-x-reports", error="invalid_token"`)
+			renderError(w, "INVALID_TOKEN", http.StatusUnauthorized)
+			return
+		}
+		err = checkUploadNames(r)
+		if err != nil {
+			renderError(w, "INVALID_NAME", http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+		org, app := r.Header.Get("X-Org"), r.Header.Get("X-App")
+		if !identity.allows(org, app) {
+			renderError(w, "NOT_ALLOWED_TO_UPLOAD", http.StatusForbidden)
+			log.Printf("%s is not allowed to upload reports for %s/%s\n", identity.Name, org, app)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, identity)))
+	})
+}
+
+// requestIdentity returns who authenticated the request, or nil if uploads don't authenticate
+func requestIdentity(r *http.Request) *uploadIdentity {
+	identity, _ := r.Context().Value(identityKey{}).(*uploadIdentity)
+	return identity
+}
+
+// authenticate returns the identity of a token, which is either one of the static tokens or a service account
+// token TokenReview accepts, or nil if it is neither
+func authenticate(token string) (*uploadIdentity, error) {
+	config, err := loadUploadAuthConfig()
+	if err != nil {
+		return nil, err
+	}
+	for i, t := range config.Tokens {
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return &config.Tokens[i], nil
+		}
+	}
+	username, err := reviewToken(token)
+	if err != nil || username == "" {
+		return nil, err
+	}
+	for i, sa := range config.ServiceAccounts {
+		if sa.Name == username {
+			return &config.ServiceAccounts[i], nil
+		}
+	}
+	// an authenticated service account that isn't configured may not upload anything
+	return &uploadIdentity{Name: username}, nil
+}
+
+// loadUploadAuthConfig reads the Secret again once the cached copy is older than a minute
+func loadUploadAuthConfig() (*uploadAuthConfig, error) {
+	authLock.Lock()
+	defer authLock.Unlock()
+	if authConfig != nil && time.Since(authConfigLoaded) < authCacheTTL {
+		return authConfig, nil
+	}
+	config := &uploadAuthConfig{}
+	secret, err := kubernetesClient.CoreV1().Secrets(cmNamespace).Get(uploadAuthSecret, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, observeKubernetes("get_secret", err)
+	}
+	if err == nil {
+		err = yaml.Unmarshal(secret.Data[uploadAuthKey], config)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid %s in Secret %s: %s", uploadAuthKey, uploadAuthSecret, err))
+		}
+	}
+	authConfig = config
+	authConfigLoaded = time.Now()
+	return config, nil
+}
+
+// reviewToken asks Kubernetes who a token belongs to, returning no username if it isn't valid
+func reviewToken(token string) (string, error) {
+	key := sha256.Sum256([]byte(token))
+	authLock.Lock()
+	cached, ok := reviewedTokens[key]
+	authLock.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.username, nil
+	}
+	review, err := kubernetesClient.AuthenticationV1().TokenReviews().Create(&authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	})
+	if err != nil {
+		return "", observeKubernetes("create_token_review", err)
+	}
+	username := ""
+	if review.Status.Authenticated {
+		username = review.Status.User.Username
+	}
+	authLock.Lock()
+	defer authLock.Unlock()
+	for k, t := range reviewedTokens {
+		if time.Now().After(t.expires) {
+			delete(reviewedTokens, k)
+		}
+	}
+	reviewedTokens[key] = reviewedToken{username: username, expires: time.Now().Add(authCacheTTL)}
+	return username, nil
+}
+
+// namespace is the namespace of the team the identity uploads for, if it is tied to one
+func (identity *uploadIdentity) namespace() string {
+	if identity.Namespace != "" {
+		return identity.Namespace
+	}
+	if parts := strings.Split(identity.Name, ":"); len(parts) == 4 && strings.HasPrefix(identity.Name, "system:serviceaccount:") {
+		return parts[2]
+	}
+	return ""
+}
+
+// allows tells whether the identity may upload reports for an app, which never holds for invalid names
+func (identity *uploadIdentity) allows(org string, app string) bool {
+	if !validName(org) || !validName(app) {
+		return false
+	}
+	for _, pattern := range identity.Allow {
+		if pattern == "*" {
+			return true
+		}
+		if matched, _ := path.Match(pattern, org+"/"+app); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// validName tells whether an org, app, version or file name can be used as a single segment of a storage path. It
+// mustn't be empty, contain a path separator or start with a dot, which rules out "." and ".." and keeps the hidden
+// directories out of reach.
+func validName(name string) bool {
+	return name != "" && !strings.HasPrefix(name, ".") && !strings.ContainsAny(name, "/\\")
+}
+
+// checkUploadNames checks the org, app, version, branch and build an upload is for and the name of the uploaded
+// file are valid. Branches and builds are stored by their escaped names, so a branch may contain a '/'.
+func checkUploadNames(r *http.Request) error {
+	_, filename := path.Split(r.URL.Path)
+	for _, name := range []struct{ kind, value, stored string }{
+		{"X-Org", r.Header.Get("X-Org"), r.Header.Get("X-Org")},
+		{"X-App", r.Header.Get("X-App"), r.Header.Get("X-App")},
+		{"X-Version", r.Header.Get("X-Version"), r.Header.Get("X-Version")},
+		{"X-Branch", r.Header.Get("X-Branch"), storeKey(r.Header.Get("X-Branch"))},
+		{"X-Build-Number", r.Header.Get("X-Build-Number"), storeKey(r.Header.Get("X-Build-Number"))},
+		{"file name", filename, filename},
+	} {
+		if !validName(name.stored) {
+			return errors.New(fmt.Sprintf("invalid %s %q", name.kind, name.value))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestValidName(t *testing.T) {
+	for name, valid := range map[string]bool{
+		"myorg":       true,
+		"my-app_2":    true,
+		"1.0.0":       true,
+		"junit.xml":   true,
+		"":            false,
+		".":           false,
+		"..":          false,
+		".teams":      false,
+		".blobs":      false,
+		"a/b":         false,
+		"../etc":      false,
+		`a\b`:         false,
+		`..\..\etc`:   false,
+		"..%2f..%2fa": false,
+	} {
+		if validName(name) != valid {
+			t.Errorf("expected validName(%q) to be %v", name, valid)
+		}
+	}
+}
+
+func TestAuthenticateUploadsRejectsInvalidNames(t *testing.T) {
+	flagUploadAuth, authConfig, authConfigLoaded = true, &uploadAuthConfig{Tokens: []uploadIdentity{
+		{Name: "myorg-pipeline", Token: "secret", Allow: []string{"myorg/*"}},
+	}}, time.Now()
+	defer func() {
+		flagUploadAuth, authConfig = false, nil
+	}()
+	for _, test := range []struct {
+		name    string
+		path    string
+		org     string
+		app     string
+		version string
+		branch  string
+		build   string
+		status  int
+	}{
+		{"allowed", "/junit.xml", "myorg", "myapp", "1.0.0", "master", "7", http.StatusOK},
+		{"other org", "/junit.xml", "otherorg", "myapp", "1.0.0", "master", "7", http.StatusForbidden},
+		{"empty app", "/junit.xml", "myorg", "", "1.0.0", "master", "7", http.StatusBadRequest},
+		{"app traversal", "/junit.xml", "myorg", "..", "1.0.0", "master", "7", http.StatusBadRequest},
+		{"app out of the org", "/junit.xml", "myorg", "../otherorg", "1.0.0", "master", "7", http.StatusBadRequest},
+		{"app with backslash", "/junit.xml", "myorg", `..\otherorg`, "1.0.0", "master", "7",
+			http.StatusBadRequest},
+		{"hidden app", "/junit.xml", "myorg", ".teams", "1.0.0", "master", "7", http.StatusBadRequest},
+		{"current org", "/junit.xml", ".", "myapp", "1.0.0", "master", "7", http.StatusBadRequest},
+		{"version traversal", "/junit.xml", "myorg", "myapp", "../../otherorg/otherapp/1.0.0", "master", "7",
+			http.StatusBadRequest},
+		{"dot version", "/junit.xml", "myorg", "myapp", ".", "master", "7", http.StatusBadRequest},
+		{"parent file", "/..", "myorg", "myapp", "1.0.0", "master", "7", http.StatusBadRequest},
+		{"hidden file", "/.manifest.json", "myorg", "myapp", "1.0.0", "master", "7", http.StatusBadRequest},
+		{"no file", "/", "myorg", "myapp", "1.0.0", "master", "7", http.StatusBadRequest},
+		{"branch with a slash", "/junit.xml", "myorg", "myapp", "1.0.0", "feature/login", "7", http.StatusOK},
+		{"branch traversal", "/junit.xml", "myorg", "myapp", "1.0.0", "..", "7", http.StatusBadRequest},
+		{"hidden branch", "/junit.xml", "myorg", "myapp", "1.0.0", ".index", "7", http.StatusBadRequest},
+		{"empty branch", "/junit.xml", "myorg", "myapp", "1.0.0", "", "7", http.StatusBadRequest},
+		{"build traversal", "/junit.xml", "myorg", "myapp", "1.0.0", "master", "..", http.StatusBadRequest},
+		{"build with a backslash", "/junit.xml", "myorg", "myapp", "1.0.0", "master", `..\..`, http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest(http.MethodPost, test.path, nil)
+		r.Header.Set("Authorization", "Bearer secret")
+		r.Header.Set("X-Org", test.org)
+		r.Header.Set("X-App", test.app)
+		r.Header.Set("X-Version", test.version)
+		r.Header.Set("X-Branch", test.branch)
+		r.Header.Set("X-Build-Number", test.build)
+		w := httptest.NewRecorder()
+		authenticateUploads(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		})(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+		}
+	}
+}
+
+func TestUploadIdentityAllows(t *testing.T) {
+	identity := &uploadIdentity{Name: "everything", Allow: []string{"*"}}
+	for _, app := range []string{"myapp", "my-app_2"} {
+		if !identity.allows("myorg", app) {
+			t.Errorf("expected %s to be allowed", app)
+		}
+	}
+	for _, app := range []string{"", "..", ".blobs", "a/b"} {
+		if identity.allows("myorg", app) {
+			t.Errorf("expected %q not to be allowed", app)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// blobsDir holds the content of every report file once, by its SHA-256, within each storage root. Report files are
+// hard links to their blob, so the download server serves them like any other file, and a blob is referenced as
+// long as it has more than the one link of the blob store itself.
+const blobsDir = ".blobs"
+
+var blobsLock sync.Mutex
+
+func blobFile(root string, sum string) string {
+	return filepath.Join(root, blobsDir, sum[:2], sum)
+}
+
+// storeBlob stores data at path within a storage root as a link to the blob of its content, storing the blob first
+// unless identical content has been stored before. The file at path is replaced atomically. Where the volume
+// doesn't support hard links the file is written on its own.
+func storeBlob(root string, path string, data []byte) error {
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	blob := blobFile(root, sum)
+	dir := filepath.Dir(path)
+	err := os.MkdirAll(dir, os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	// the lock keeps the garbage collector from removing the blob before it is linked
+	blobsLock.Lock()
+	defer blobsLock.Unlock()
+	if _, err := os.Stat(blob); os.IsNotExist(err) {
+		err = writeBlob(blob, data)
+		if err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+	link := filepath.Join(dir, fmt.Sprintf(".link-%s-%d", sum[:12], time.Now().UnixNano()))
+	err = os.Link(blob, link)
+	if err != nil {
+		log.Printf("Can't link %s to its blob, storing it on its own: %s\n", path, err)
+		return writeFile(path, data)
+	}
+	err = os.Rename(link, path)
+	// renaming onto a link to the same blob leaves both in place
+	os.Remove(link)
+	return err
+}
+
+// writeBlob stores a blob read-only, as changing it would change every file linked to it
+func writeBlob(blob string, data []byte) error {
+	err := writeFile(blob, data)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(blob, os.FileMode(0444))
+}
+
+// writeFile writes data to a temporary file next to path and renames it into place, so readers never see a
+// partial file
+func writeFile(path string, data []byte) error {
+	err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// collectBlobs removes the blobs no report file links to any more from every storage root, returning how many
+// there were and the bytes they took up. Nothing is removed in a dry run.
+func collectBlobs(dryRun bool) (int, int64, error) {
+	blobsLock.Lock()
+	defer blobsLock.Unlock()
+	count, size := 0, int64(0)
+	for _, root := range teamRoots(uploadPath) {
+		err := filepath.Walk(filepath.Join(root, blobsDir), func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+				return nil
+			}
+			stat, ok := info.Sys().(*syscall.Stat_t)
+			if !ok || stat.Nlink > 1 {
+				return nil
+			}
+			count++
+			size += info.Size()
+			if dryRun {
+				return nil
+			}
+			return os.Remove(path)
+		})
+		if err != nil {
+			return count, size, err
+		}
+	}
+	return count, size, nil
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	"io/ioutil"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var buildsLock sync.Mutex
+
+// testTotals counts the test cases of one or more JUnit reports
+type testTotals struct {
+	Tests    int     `json:"tests"`
+	Passed   int     `json:"passed"`
+	Failures int     `json:"failures"`
+	Errors   int     `json:"errors"`
+	Skipped  int     `json:"skipped"`
+	Time     float64 `json:"time"`
+}
+
+// buildReport is a single report uploaded for a build, along with the results extracted from it
+type buildReport struct {
+	Name        string          `json:"name"`
+	URL         string          `json:"url"`
+	ContentType string          `json:"contentType,omitempty"`
+	Uploaded    time.Time       `json:"uploaded"`
+	Tests       *testTotals     `json:"tests,omitempty"`
+	FailedTests []string        `json:"failedTests,omitempty"`
+	Coverage    *coverageResult `json:"coverage,omitempty"`
+	Findings    map[string]int  `json:"findings,omitempty"`
+	SHA256      string          `json:"sha256,omitempty"`
+}
+
+// buildRecord accumulates every report uploaded for a build. Reports are keyed by file name so uploading the same
+// file again replaces its results rather than counting them twice.
+type buildRecord struct {
+	Org      string                  `json:"org"`
+	App      string                  `json:"app"`
+	Version  string                  `json:"version"`
+	Branch   string                  `json:"branch"`
+	Build    string                  `json:"build"`
+	Reports  map[string]*buildReport `json:"reports"`
+	Verdict  *gateVerdict            `json:"verdict,omitempty"`
+	Summary  *buildSummary           `json:"summary,omitempty"`
+	Activity *activityLinks          `json:"activity,omitempty"`
+	Created  time.Time               `json:"created"`
+	Updated  time.Time               `json:"updated"`
+}
+
+func (report *buildReport) addTests(suites []junitTestSuite) {
+	totals := &testTotals{}
+	failed := map[string]bool{}
+	for _, s := range suites {
+		totals.Time += parseJUnitFloat(s.Time)
+		for _, tc := range s.TestCases {
+			totals.Tests++
+			switch tc.Status() {
+			case testStatusPassed:
+				totals.Passed++
+			case testStatusFailed:
+				totals.Failures++
+				failed[tc.ID(s.Name)] = true
+			case testStatusError:
+				totals.Errors++
+				failed[tc.ID(s.Name)] = true
+			case testStatusSkipped:
+				totals.Skipped++
+			}
+		}
+	}
+	report.Tests = totals
+	report.FailedTests = sortedKeys(failed)
+}
+
+func buildsDir(org string, app string, branch string) string {
+	return filepath.Join(appDataPath(org, app), "builds", org, app, storeKey(branch))
+}
+
+func buildFile(org string, app string, branch string, buildNo string) string {
+	return filepath.Join(buildsDir(org, app, branch), storeKey(buildNo)+".json")
+}
+
+// loadBuildRecord returns the record of a build, which has no reports if nothing has been uploaded for it yet
+func loadBuildRecord(org string, app string, branch string, buildNo string) (*buildRecord, error) {
+	b := &buildRecord{Org: org, App: app, Branch: branch, Build: buildNo}
+	err := readJSON(buildFile(org, app, branch, buildNo), b)
+	if err != nil {
+		return nil, err
+	}
+	if b.Reports == nil {
+		b.Reports = map[string]*buildReport{}
+	}
+	return b, nil
+}
+
+// recordBuildReport adds an uploaded report to the record of its build
+func recordBuildReport(org string, app string, version string, branch string, buildNo string, report *buildReport, pa *jenkinsxv1.PipelineActivity) (*buildRecord, error) {
+	return updateBuildRecord(org, app, branch, buildNo, func(b *buildRecord) {
+		b.Version = version
+		b.Reports[report.Name] = report
+		if pa != nil {
+			b.Activity = newActivityLinks(pa)
+		}
+	})
+}
+
+// updateBuildRecord applies update to the record of a build, stores it again and refreshes the app manifest
+func updateBuildRecord(org string, app string, branch string, buildNo string, update func(*buildRecord)) (*buildRecord, error) {
+	buildsLock.Lock()
+	defer buildsLock.Unlock()
+
+	b, err := loadBuildRecord(org, app, branch, buildNo)
+	if err != nil {
+		return nil, err
+	}
+	update(b)
+	b.Updated = time.Now().UTC()
+	if b.Created.IsZero() {
+		b.Created = b.Updated
+		if reports := b.sortedReports(); len(reports) > 0 {
+			b.Created = reports[0].Uploaded
+		}
+	}
+	err = writeJSON(buildFile(org, app, branch, buildNo), b)
+	if err != nil {
+		return nil, err
+	}
+	err = updateAppManifest(b)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// listBuilds returns the build numbers recorded for a branch, oldest first
+func listBuilds(org string, app string, branch string) ([]string, error) {
+	files, err := ioutil.ReadDir(buildsDir(org, app, branch))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var builds []string
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		buildNo, err := neturl.PathUnescape(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		builds = append(builds, buildNo)
+	}
+	sortBuildNumbers(builds)
+	return builds, nil
+}
+
+// latestBuildRecord returns the most recent build of a branch other than excludeBuild, or nil if there is none
+func latestBuildRecord(org string, app string, branch string, excludeBuild string) (*buildRecord, error) {
+	builds, err := listBuilds(org, app, branch)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(builds) - 1; i >= 0; i-- {
+		if builds[i] != excludeBuild {
+			return loadBuildRecord(org, app, branch, builds[i])
+		}
+	}
+	return nil, nil
+}
+
+// sortBuildNumbers orders build numbers numerically, falling back to lexical order for anything else
+func sortBuildNumbers(builds []string) {
+	sort.Slice(builds, func(i, j int) bool {
+		a, errA := strconv.Atoi(builds[i])
+		b, errB := strconv.Atoi(builds[j])
+		if errA == nil && errB == nil {
+			return a < b
+		}
+		return builds[i] < builds[j]
+	})
+}
+
+// testTotals adds up the tests of every JUnit report of the build
+func (b *buildRecord) testTotals() *testTotals {
+	var totals *testTotals
+	for _, report := range b.Reports {
+		if report.Tests == nil {
+			continue
+		}
+		if totals == nil {
+			totals = &testTotals{}
+		}
+		totals.Tests += report.Tests.Tests
+		totals.Passed += report.Tests.Passed
+		totals.Failures += report.Tests.Failures
+		totals.Errors += report.Tests.Errors
+		totals.Skipped += report.Tests.Skipped
+		totals.Time += report.Tests.Time
+	}
+	return totals
+}
+
+// failedTests returns the failing tests of every JUnit report of the build
+func (b *buildRecord) failedTests() []string {
+	failed := map[string]bool{}
+	for _, report := range b.Reports {
+		for _, name := range report.FailedTests {
+			failed[name] = true
+		}
+	}
+	return sortedKeys(failed)
+}
+
+// coverage combines the coverage reports of the build, weighted by lines where the reports say how many there are
+func (b *buildRecord) coverage() *coverageResult {
+	var reports []*coverageResult
+	for _, report := range b.Reports {
+		if report.Coverage != nil {
+			reports = append(reports, report.Coverage)
+		}
+	}
+	if len(reports) == 0 {
+		return nil
+	}
+	weighted := true
+	lines, covered, percent := 0, 0, 0.0
+	for _, c := range reports {
+		lines += c.Lines
+		covered += c.Covered
+		percent += c.Percent
+		if c.Lines == 0 {
+			weighted = false
+		}
+	}
+	if weighted {
+		return &coverageResult{Lines: lines, Covered: covered, Percent: 100 * float64(covered) / float64(lines)}
+	}
+	return &coverageResult{Percent: percent / float64(len(reports))}
+}
+
+// findings adds up the findings of every analysis report of the build by severity
+func (b *buildRecord) findings() map[string]int {
+	var findings map[string]int
+	for _, report := range b.Reports {
+		for severity, count := range report.Findings {
+			if findings == nil {
+				findings = map[string]int{}
+			}
+			findings[severity] += count
+		}
+	}
+	return findings
+}
+
+// sortedReports returns the reports of the build in upload order
+func (b *buildRecord) sortedReports() []*buildReport {
+	var reports []*buildReport
+	for _, report := range b.Reports {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		if !reports[i].Uploaded.Equal(reports[j].Uploaded) {
+			return reports[i].Uploaded.Before(reports[j].Uploaded)
+		}
+		return reports[i].Name < reports[j].Name
+	})
+	return reports
+}
+
+func sortedKeys(m map[string]bool) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// flagCompressReports stores text reports gzip-compressed
+var flagCompressReports = os.Getenv("COMPRESS_REPORTS") == "true"
+
+// compressedSuffix is added to the name of report files stored compressed, uploads can't use it
+const compressedSuffix = ".at-rest.gz"
+
+// minCompressSize is the size below which compressing a report isn't worth it
+const minCompressSize = 1024
+
+// compressibleExtensions are the extensions of the reports that are compressed, along with anything that looks like
+// text
+var compressibleExtensions = map[string]bool{
+	".xml": true, ".json": true, ".sarif": true, ".html": true, ".htm": true, ".txt": true, ".log": true,
+	".css": true, ".js": true, ".svg": true, ".csv": true,
+}
+
+// compressReport returns the name and content to store an uploaded report with, which is gzip-compressed if
+// compression is enabled and makes it smaller
+func compressReport(name string, data []byte) (string, []byte) {
+	if !flagCompressReports || len(data) < minCompressSize || !isCompressible(name, data) {
+		return name, data
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if _, err := gz.Write(data); err != nil {
+		return name, data
+	}
+	if err := gz.Close(); err != nil {
+		return name, data
+	}
+	if compressed.Len() >= len(data) {
+		return name, data
+	}
+	return name + compressedSuffix, compressed.Bytes()
+}
+
+func isCompressible(name string, data []byte) bool {
+	if compressibleExtensions[strings.ToLower(path.Ext(name))] {
+		return true
+	}
+	contentType := http.DetectContentType(data)
+	return strings.HasPrefix(contentType, "text/") || strings.Contains(contentType, "xml") ||
+		strings.Contains(contentType, "json")
+}
+
+// statStoredFile returns the file a report at path is stored in, compressed or not
+func statStoredFile(path string) (os.FileInfo, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return os.Stat(path + compressedSuffix)
+	}
+	return info, err
+}
+
+// removeOtherVariant removes the report at path stored the other way than it is at stored, e.g. an uncompressed
+// report that has been uploaded again and compressed this time
+func removeOtherVariant(path string, stored string) error {
+	other := path + compressedSuffix
+	if stored != path {
+		other = path
+	}
+	err := os.Remove(other)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// readStoredFile reads the report at path, decompressing it if it is stored compressed
+func readStoredFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if !os.IsNotExist(err) {
+		return data, err
+	}
+	data, err = ioutil.ReadFile(path + compressedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	return gunzip(data)
+}
+
+func gunzip(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return ioutil.ReadAll(gz)
+}
+
+// uncompressedSize reads the size of a compressed report from the gzip trailer, which is exact for anything
+// smaller than 4 GiB
+func uncompressedSize(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	_, err = f.Seek(-4, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	var size uint32
+	err = binary.Read(f, binary.LittleEndian, &size)
+	return int64(size), err
+}
+
+// storedFile is a report file stored compressed, as it was uploaded
+type storedFile struct {
+	*bytes.Reader
+	info os.FileInfo
+}
+
+func (f *storedFile) Close() error {
+	return nil
+}
+
+func (f *storedFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (f *storedFile) Stat() (os.FileInfo, error) {
+	return f.info, nil
+}
+
+// openCompressed opens the report stored compressed for name, decompressing it
+func openCompressed(dir http.Dir, name string) (http.File, error) {
+	f, err := dir.Open(name + compressedSuffix)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	data, err = gunzip(data)
+	if err != nil {
+		return nil, err
+	}
+	return &storedFile{Reader: bytes.NewReader(data), info: &storedFileInfo{info, path.Base(name), int64(len(data))}}, nil
+}
+
+// storedFileInfo describes a report stored compressed with its name and size as it was uploaded
+type storedFileInfo struct {
+	os.FileInfo
+	name string
+	size int64
+}
+
+func (info *storedFileInfo) Name() string {
+	return info.name
+}
+
+func (info *storedFileInfo) Size() int64 {
+	return info.size
+}
+
+// storedDir lists a report directory with the reports stored compressed under the names they were uploaded with,
+// leaving out the files the storage uses itself
+type storedDir struct {
+	http.File
+	path string
+}
+
+func (dir *storedDir) Readdir(count int) ([]os.FileInfo, error) {
+	entries, err := dir.File.Readdir(count)
+	var infos []os.FileInfo
+	for _, info := range entries {
+		if strings.HasPrefix(info.Name(), ".") {
+			continue
+		}
+		if name := info.Name(); strings.HasSuffix(name, compressedSuffix) && !info.IsDir() {
+			size, sizeErr := uncompressedSize(filepath.Join(dir.path, name))
+			if sizeErr != nil {
+				size = info.Size()
+			}
+			info = &storedFileInfo{info, strings.TrimSuffix(name, compressedSuffix), size}
+		}
+		infos = append(infos, info)
+	}
+	return infos, err
+}
+
+// acceptsGzip tells whether the client accepts gzip-encoded responses. An explicit gzip coding takes precedence over
+// the * wildcard, whichever comes first.
+func acceptsGzip(r *http.Request) bool {
+	wildcard := false
+	for _, coding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(coding, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name != "gzip" && name != "*" {
+			continue
+		}
+		accepted := true
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil && q == 0 {
+					accepted = false
+				}
+			}
+		}
+		if name == "gzip" {
+			return accepted
+		}
+		wildcard = accepted
+	}
+	return wildcard
+}
+
+// serveCompressed serves a report stored compressed as it is to clients accepting gzip, and decompressed to anyone
+// else or to range requests, returning false if the report isn't stored compressed. Both representations have
+// their own ETag, and http.ServeContent takes care of ranges and conditional requests.
+func serveCompressed(w http.ResponseWriter, r *http.Request, root teamFileSystem) bool {
+	dir, name, ok := root.reportDir(r.URL.Path)
+	if !ok {
+		return false
+	}
+	f, err := dir.Open(name + compressedSuffix)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return false
+	}
+	etag := fmt.Sprintf("%x", sha256.Sum256(data))[:32]
+	w.Header().Set("Vary", "Accept-Encoding")
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		// sniffing the compressed content would take it for gzip
+		raw, _ := gunzip(data)
+		contentType = http.DetectContentType(raw)
+	}
+	w.Header().Set("Content-Type", contentType)
+	if acceptsGzip(r) && r.Header.Get("Range") == "" {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("ETag", `"`+etag+`-gzip"`)
+		http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(data))
+		return true
+	}
+	data, err = gunzip(data)
+	if err != nil {
+		renderError(w, "CANT_READ_FILE", http.StatusInternalServerError)
+		return true
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, r, name, info.ModTime(), bytes.NewReader(data))
+	return true
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for _, test := range []struct {
+		acceptEncoding string
+		accepts        bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip", true},
+		{"gzip;q=0.5", true},
+		{"gzip; q=0", false},
+		{"gzip;q=0.0", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"br, *", true},
+		{"br", false},
+		{"*;q=0, gzip", true},
+		{"gzip, *;q=0", true},
+		{"gzip;q=0, *", false},
+		{"*, gzip;q=0", false},
+		{"identity", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/myorg/web/1.0.0/junit.xml", nil)
+		r.Header.Set("Accept-Encoding", test.acceptEncoding)
+		if accepts := acceptsGzip(r); accepts != test.accepts {
+			t.Errorf("%q: expected %v, got %v", test.acceptEncoding, test.accepts, accepts)
+		}
+	}
+}
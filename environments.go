@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// promotion is a version of an app Jenkins X promoted to an Environment, as recorded by a Promote step of the
+// PipelineActivity of its release
+type promotion struct {
+	Environment    string    `json:"environment"`
+	Version        string    `json:"version"`
+	Promoted       time.Time `json:"promoted"`
+	Activity       string    `json:"activity"`
+	PullRequestURL string    `json:"pullRequestUrl,omitempty"`
+	ApplicationURL string    `json:"applicationUrl,omitempty"`
+}
+
+// environmentView is an Environment of the team of an app, with the version of the app running in it and the
+// outcome of the reports of that version
+type environmentView struct {
+	Name      string          `json:"name"`
+	Label     string          `json:"label,omitempty"`
+	Order     int32           `json:"order"`
+	Namespace string          `json:"namespace,omitempty"`
+	Promotion *promotion      `json:"promotion,omitempty"`
+	Build     *buildManifest  `json:"build,omitempty"`
+	Summary   *versionSummary `json:"summary,omitempty"`
+}
+
+// promotionCheck tells a promotion pipeline whether a version may be promoted
+type promotionCheck struct {
+	Org         string       `json:"org"`
+	App         string       `json:"app"`
+	Version     string       `json:"version"`
+	Environment string       `json:"environment,omitempty"`
+	Promotable  bool         `json:"promotable"`
+	Build       string       `json:"build,omitempty"`
+	Status      string       `json:"status,omitempty"`
+	Verdict     *gateVerdict `json:"verdict,omitempty"`
+	Reasons     []string     `json:"reasons,omitempty"`
+}
+
+// appPromotions returns the successful promotions of an app, most recent first, from the Promote steps of the
+// PipelineActivities of its team
+func appPromotions(org string, app string) ([]*promotion, error) {
+	list, err := jenkinsClient.JenkinsV1().PipelineActivities(appNamespace(org, app)).List(metav1.ListOptions{})
+	if err = observeKubernetes("list_pipeline_activities", err); err != nil {
+		return nil, err
+	}
+	var promotions []*promotion
+	for _, pa := range list.Items {
+		if !strings.HasPrefix(pa.Spec.Pipeline, org+"/"+app+"/") || pa.Spec.Version == "" {
+			continue
+		}
+		for _, step := range pa.Spec.Steps {
+			promote := step.Promote
+			if promote == nil || promote.Environment == "" ||
+				promote.Status != jenkinsxv1.ActivityStatusTypeSucceeded {
+				continue
+			}
+			p := &promotion{Environment: promote.Environment, Version: pa.Spec.Version, Activity: pa.Name,
+				ApplicationURL: promote.ApplicationURL}
+			if promote.CompletedTimestamp != nil {
+				p.Promoted = promote.CompletedTimestamp.Time
+			} else if promote.StartedTimestamp != nil {
+				p.Promoted = promote.StartedTimestamp.Time
+			}
+			if promote.PullRequest != nil {
+				p.PullRequestURL = promote.PullRequest.PullRequestURL
+			}
+			promotions = append(promotions, p)
+		}
+	}
+	sort.Slice(promotions, func(i, j int) bool {
+		return promotions[i].Promoted.After(promotions[j].Promoted)
+	})
+	return promotions, nil
+}
+
+// promotionEnvironments returns the Environments versions are promoted to in the namespace of the team of an app,
+// in the order of promotion
+func promotionEnvironments(org string, app string) ([]jenkinsxv1.Environment, error) {
+	list, err := jenkinsClient.JenkinsV1().Environments(appNamespace(org, app)).List(metav1.ListOptions{})
+	if err = observeKubernetes("list_environments", err); err != nil {
+		return nil, err
+	}
+	var environments []jenkinsxv1.Environment
+	for _, env := range list.Items {
+		if env.Spec.Kind == "" || env.Spec.Kind == jenkinsxv1.EnvironmentKindTypePermanent {
+			environments = append(environments, env)
+		}
+	}
+	sort.Slice(environments, func(i, j int) bool {
+		if environments[i].Spec.Order != environments[j].Spec.Order {
+			return environments[i].Spec.Order < environments[j].Spec.Order
+		}
+		return environments[i].Name < environments[j].Name
+	})
+	return environments, nil
+}
+
+// appEnvironments returns the Environments of the team of an app with the version of the app promoted to each last
+func appEnvironments(org string, app string) ([]*environmentView, error) {
+	environments, err := promotionEnvironments(org, app)
+	if err != nil {
+		return nil, err
+	}
+	promotions, err := appPromotions(org, app)
+	if err != nil {
+		return nil, err
+	}
+	m, err := loadAppManifest(org, app)
+	if err != nil {
+		return nil, err
+	}
+	views := []*environmentView{}
+	for _, env := range environments {
+		view := &environmentView{Name: env.Name, Label: env.Spec.Label, Order: env.Spec.Order,
+			Namespace: env.Spec.Namespace}
+		for _, p := range promotions {
+			if p.Environment == env.Name {
+				view.Promotion = p
+				break
+			}
+		}
+		if view.Promotion != nil {
+			if v := manifestVersion(m, view.Promotion.Version); v != nil {
+				view.Build = v.latestBuild()
+				view.Summary, err = summarizeVersion(org, app, v)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// manifestVersion returns the version of the manifest Jenkins X knows as version, which may have a v it hasn't or
+// the other way round
+func manifestVersion(m *appManifest, version string) *versionManifest {
+	if v := m.Versions[version]; v != nil {
+		return v
+	}
+	for _, v := range m.Versions {
+		if trimVersion(v.Version) == trimVersion(version) {
+			return v
+		}
+	}
+	return nil
+}
+
+// checkPromotion tells whether the latest build of a version has passed its quality gates, and when promoting to
+// an Environment, whether the version has been promoted to every Environment before it
+func checkPromotion(org string, app string, v *versionManifest, environment string) (*promotionCheck, error) {
+	check := &promotionCheck{Org: org, App: app, Version: v.Version, Environment: environment}
+	latest := v.latestBuild()
+	if latest == nil {
+		check.Reasons = append(check.Reasons, "no build of the version has reports")
+	} else {
+		b, err := loadBuildRecord(org, app, latest.Branch, latest.Build)
+		if err != nil {
+			return nil, err
+		}
+		check.Build = buildKey(latest.Branch, latest.Build)
+		check.Status = latest.Status
+		check.Verdict = b.Verdict
+		switch latest.Status {
+		case gatePassed:
+		case "":
+			check.Reasons = append(check.Reasons, fmt.Sprintf("build %s has no results", check.Build))
+		default:
+			check.Reasons = append(check.Reasons, fmt.Sprintf("build %s is %s", check.Build, latest.Status))
+			if b.Verdict != nil {
+				for _, gate := range b.Verdict.failedGates() {
+					check.Reasons = append(check.Reasons, fmt.Sprintf("quality gate %s failed (threshold %s, actual %s)",
+						gate.Name, gate.Threshold, gate.Actual))
+				}
+			}
+		}
+	}
+	if environment != "" {
+		reasons, err := missingPromotions(org, app, v.Version, environment)
+		if err != nil {
+			return nil, err
+		}
+		check.Reasons = append(check.Reasons, reasons...)
+	}
+	check.Promotable = len(check.Reasons) == 0
+	return check, nil
+}
+
+// missingPromotions lists the Environments ordered before environment the version was never promoted to
+func missingPromotions(org string, app string, version string, environment string) ([]string, error) {
+	environments, err := promotionEnvironments(org, app)
+	if err != nil {
+		return nil, err
+	}
+	var target *jenkinsxv1.Environment
+	for i, env := range environments {
+		if env.Name == environment {
+			target = &environments[i]
+		}
+	}
+	if target == nil {
+		return []string{fmt.Sprintf("there is no Environment %s", environment)}, nil
+	}
+	promotions, err := appPromotions(org, app)
+	if err != nil {
+		return nil, err
+	}
+	var reasons []string
+	for _, env := range environments {
+		if env.Spec.Order >= target.Spec.Order || env.Spec.PromotionStrategy == jenkinsxv1.PromotionStrategyTypeNever {
+			continue
+		}
+		promoted := false
+		for _, p := range promotions {
+			if p.Environment == env.Name && trimVersion(p.Version) == trimVersion(version) {
+				promoted = true
+				break
+			}
+		}
+		if !promoted {
+			reasons = append(reasons, fmt.Sprintf("version %s was never promoted to %s", version, env.Name))
+		}
+	}
+	return reasons, nil
+}
+
+// environmentsHandler serves the Environments of the team of an app with the version running in each
+func environmentsHandler(w http.ResponseWriter, r *http.Request, org string, app string) {
+	views, err := appEnvironments(org, app)
+	if err != nil {
+		renderJSONError(w, "CANT_READ_ENVIRONMENTS", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	renderAPI(w, r, views)
+}
+
+// promotionHandler tells a promotion pipeline whether a version may be promoted to the Environment given by the
+// environment parameter, e.g. curl -f .../versions/1.0.3/promotion?environment=production before jx promote.
+// Versions that may not be promoted get a 412 along with the reasons.
+func promotionHandler(w http.ResponseWriter, r *http.Request, m *appManifest, v *versionManifest) {
+	check, err := checkPromotion(m.Org, m.App, v, r.URL.Query().Get("environment"))
+	if err != nil {
+		renderJSONError(w, "CANT_CHECK_PROMOTION", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	outcome := "promotable"
+	status := http.StatusOK
+	if !check.Promotable {
+		outcome = "rejected"
+		status = http.StatusPreconditionFailed
+	}
+	promotionChecksTotal.add(1, m.Org, outcome)
+	renderJSON(w, check, status)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	json2 "encoding/json"
+	"errors"
+	"fmt"
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	corev1 "k8s.io/api/core/v1"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const summaryAnnotation = "jenkins-x-reports-summary"
+
+// reportLink points at a stored report
+type reportLink struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// buildSummary aggregates all reports of a finalized build
+type buildSummary struct {
+	Org         string          `json:"org"`
+	App         string          `json:"app"`
+	Version     string          `json:"version"`
+	Branch      string          `json:"branch"`
+	Build       string          `json:"build"`
+	Status      string          `json:"status"`
+	Tests       *testTotals     `json:"tests,omitempty"`
+	Coverage    *coverageResult `json:"coverage,omitempty"`
+	Findings    map[string]int  `json:"findings,omitempty"`
+	Duration    float64         `json:"duration"`
+	Reports     []reportLink    `json:"reports"`
+	Verdict     *gateVerdict    `json:"verdict,omitempty"`
+	Finalized   bool            `json:"finalized"`
+	FinalizedAt *time.Time      `json:"finalizedAt,omitempty"`
+}
+
+// requestBuild returns the build identified by the X-Org, X-App, X-Version, X-Build-Number and X-Branch headers
+func requestBuild(r *http.Request) (*buildRecord, error) {
+	b := &buildRecord{
+		Org:     r.Header.Get("X-Org"),
+		App:     r.Header.Get("X-App"),
+		Version: r.Header.Get("X-Version"),
+		Build:   r.Header.Get("X-Build-Number"),
+		Branch:  r.Header.Get("X-Branch"),
+	}
+	for header, value := range map[string]string{
+		"X-Org":          b.Org,
+		"X-App":          b.App,
+		"X-Version":      b.Version,
+		"X-Build-Number": b.Build,
+		"X-Branch":       b.Branch,
+	} {
+		if value == "" {
+			return nil, errors.New(fmt.Sprintf("No %s header provided", header))
+		}
+	}
+	return b, nil
+}
+
+// finalizeBuildHandler is called once every report of a build has been uploaded. It aggregates the reports into a
+// build summary, evaluates the quality gates with gates lacking reports failing rather than pending, and pushes the
+// summary to the ConfigMap and PipelineActivity in a single update each. The summary is returned as JSON.
+func finalizeBuildHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			renderJSONError(w, "METHOD_NOT_ALLOWED", http.StatusMethodNotAllowed)
+			return
+		}
+		requested, err := requestBuild(r)
+		if err != nil {
+			renderJSONError(w, "MUST_PROVIDE_BUILD_HEADERS", http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+		err = checkUploadNames(r)
+		if err != nil {
+			renderJSONError(w, "INVALID_NAME", http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+		namespace, err := requestNamespace(r)
+		if err == nil && namespace != appNamespace(requested.Org, requested.App) {
+			err = errAppOfAnotherTeam
+		}
+		if err != nil {
+			renderJSONError(w, "NAMESPACE_NOT_ALLOWED", http.StatusForbidden)
+			log.Println(err)
+			return
+		}
+		b, err := loadBuildRecord(requested.Org, requested.App, requested.Branch, requested.Build)
+		if err != nil {
+			renderJSONError(w, "CANT_READ_BUILD", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		b.Version = requested.Version
+		verdict, err := evaluateQualityGates(b, true)
+		if err != nil {
+			renderJSONError(w, "ERROR_EVALUATING_QUALITY_GATES", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		pa, err := getPipelineActivity(b.Build, b.Branch, b.Org, b.App)
+		if err != nil {
+			// the summary is still worth having without the build timings
+			log.Println(err)
+			pa = nil
+		}
+		summary := b.summarize(verdict, pa)
+		summary.Finalized = true
+		now := time.Now().UTC()
+		summary.FinalizedAt = &now
+		_, err = updateBuildRecord(b.Org, b.App, b.Branch, b.Build, func(record *buildRecord) {
+			record.Version = b.Version
+			record.Verdict = verdict
+			record.Summary = summary
+			if pa != nil {
+				record.Activity = newActivityLinks(pa)
+			}
+		})
+		if err != nil {
+			renderJSONError(w, "CANT_WRITE_BUILD", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+
+		cm, err := getOrCreateConfigMap(b.Org, b.App)
+		if err == nil {
+			err = finalizeConfigMap(cm, summary)
+		}
+		if err == nil {
+			_, err = kubernetesClient.CoreV1().ConfigMaps(cm.Namespace).Update(cm)
+			err = observeKubernetes("update_config_map", err)
+		}
+		if err != nil {
+			renderJSONError(w, "ERROR_UPDATING_CONFIG_MAP", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		_, err = annotatePipelineActivity(b.Build, b.Branch, b.Org, b.App, summary.annotate)
+		if err != nil {
+			renderJSONError(w, "ERROR_UPDATING_PIPELINE_ACTIVITY", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		// the Release may not exist yet, it is annotated once it is created then
+		err = linkRelease(b.Org, b.App, b.Version)
+		if err != nil {
+			log.Println(err)
+		}
+		w.Header().Set("X-Quality-Gate", verdict.Status)
+		renderJSON(w, summary, http.StatusOK)
+	})
+}
+
+// summarize aggregates the reports of the build. The duration is taken from the PipelineActivity if there is one,
+// otherwise it is the time between the first and last upload. The verdict may be nil for builds which haven't been
+// evaluated yet.
+func (b *buildRecord) summarize(verdict *gateVerdict, pa *jenkinsxv1.PipelineActivity) *buildSummary {
+	summary := &buildSummary{
+		Org:      b.Org,
+		App:      b.App,
+		Version:  b.Version,
+		Branch:   b.Branch,
+		Build:    b.Build,
+		Tests:    b.testTotals(),
+		Coverage: b.coverage(),
+		Findings: b.findings(),
+		Reports:  []reportLink{},
+		Verdict:  verdict,
+	}
+	if verdict != nil {
+		summary.Status = verdict.Status
+	} else {
+		summary.Status = b.status()
+	}
+	reports := b.sortedReports()
+	for _, report := range reports {
+		summary.Reports = append(summary.Reports, reportLink{Name: report.Name, URL: report.URL})
+	}
+	switch {
+	case pa != nil && pa.Spec.StartedTimestamp != nil:
+		end := time.Now().UTC()
+		if pa.Spec.CompletedTimestamp != nil {
+			end = pa.Spec.CompletedTimestamp.Time
+		}
+		summary.Duration = end.Sub(pa.Spec.StartedTimestamp.Time).Seconds()
+	case len(reports) > 0:
+		summary.Duration = reports[len(reports)-1].Uploaded.Sub(reports[0].Uploaded).Seconds()
+	}
+	return summary
+}
+
+// annotate records the summary, the verdict and every report not yet listed on the PipelineActivity annotations
+func (summary *buildSummary) annotate(annotations map[string]string) {
+	for _, report := range summary.Reports {
+		line := fmt.Sprintf("- %s: %s\n", report.Name, report.URL)
+		if !strings.Contains(annotations[reportsAnnotation], line) {
+			annotations[reportsAnnotation] += line
+		}
+	}
+	verdict, _ := json2.Marshal(summary.Verdict)
+	annotations[qualityGateAnnotation] = string(verdict)
+	data, _ := json2.Marshal(summary)
+	annotations[summaryAnnotation] = string(data)
+}
+
+// finalizeConfigMap lists the reports of the version and adds the summary as <version>.summary
+func finalizeConfigMap(cm *corev1.ConfigMap, summary *buildSummary) error {
+	m, err := loadAppManifest(summary.Org, summary.App)
+	if err != nil {
+		return err
+	}
+	setConfigMapVersion(cm, m.Versions[summary.Version])
+	data, _ := json2.Marshal(summary)
+	cm.Data[summary.Version+".summary"] = string(data)
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strconv"
+	"time"
+)
+
+// baselineBranch is the branch new failures and coverage drops are measured against
+const baselineBranch = "master"
+
+const (
+	gatePassed  = "PASSED"
+	gateFailed  = "FAILED"
+	gatePending = "PENDING"
+)
+
+const qualityGateAnnotation = "jenkins-x-reports-quality-gate"
+
+// qualityGates are the thresholds a build of an app has to meet. They are read from the <org>-<app>-quality-gates
+// ConfigMap, gates which aren't configured are not evaluated.
+type qualityGates struct {
+	MinPassRate         *float64
+	NoNewFailures       bool
+	MinCoverage         *float64
+	MaxCoverageDrop     *float64
+	MaxCriticalFindings *int
+}
+
+// gateResult is the outcome of a single quality gate
+type gateResult struct {
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Threshold string `json:"threshold"`
+	Actual    string `json:"actual,omitempty"`
+	Message   string `json:"message,omitempty"`
+}
+
+// gateVerdict is the outcome of all quality gates of a build
+type gateVerdict struct {
+	Status      string       `json:"status"`
+	Final       bool         `json:"final"`
+	Gates       []gateResult `json:"gates"`
+	Baseline    string       `json:"baseline,omitempty"`
+	EvaluatedAt time.Time    `json:"evaluatedAt"`
+}
+
+func qualityGatesConfigMapName(org string, app string) string {
+	return fmt.Sprintf("%s-%s-quality-gates", org, app)
+}
+
+// loadQualityGates reads the quality gates of an app, an app without a ConfigMap has no gates
+func loadQualityGates(org string, app string) (*qualityGates, error) {
+	gates := &qualityGates{}
+	cm, err := kubernetesClient.CoreV1().ConfigMaps(appNamespace(org, app)).Get(qualityGatesConfigMapName(org, app), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return gates, nil
+	}
+	if observeKubernetes("get_config_map", err) != nil {
+		return nil, err
+	}
+	return parseQualityGates(cm.Data)
+}
+
+func parseQualityGates(data map[string]string) (*qualityGates, error) {
+	gates := &qualityGates{}
+	var err error
+	if gates.MinPassRate, err = parseGateFloat(data, "minPassRate"); err != nil {
+		return nil, err
+	}
+	if gates.MinCoverage, err = parseGateFloat(data, "minCoverage"); err != nil {
+		return nil, err
+	}
+	if gates.MaxCoverageDrop, err = parseGateFloat(data, "maxCoverageDrop"); err != nil {
+		return nil, err
+	}
+	if value := data["maxCriticalFindings"]; value != "" {
+		max, err := strconv.Atoi(value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid maxCriticalFindings %q: %s", value, err))
+		}
+		gates.MaxCriticalFindings = &max
+	}
+	if value := data["noNewFailures"]; value != "" {
+		gates.NoNewFailures, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid noNewFailures %q: %s", value, err))
+		}
+	}
+	return gates, nil
+}
+
+func parseGateFloat(data map[string]string, key string) (*float64, error) {
+	value := data[key]
+	if value == "" {
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("invalid %s %q: %s", key, value, err))
+	}
+	return &f, nil
+}
+
+// evaluateQualityGates checks a build against the quality gates of its app. Until the build is final, gates which
+// lack the reports they need are pending rather than failed as the reports may still be uploaded.
+func evaluateQualityGates(b *buildRecord, final bool) (*gateVerdict, error) {
+	gates, err := loadQualityGates(b.Org, b.App)
+	if err != nil {
+		return nil, err
+	}
+	var baseline *buildRecord
+	if gates.NoNewFailures || gates.MaxCoverageDrop != nil {
+		baseline, err = latestBuildRecord(b.Org, b.App, baselineBranch, b.baselineExclusion())
+		if err != nil {
+			return nil, err
+		}
+	}
+	return gates.evaluate(b, baseline, final), nil
+}
+
+// evaluateBuild evaluates the quality gates of a build and stores the verdict with the build record
+func evaluateBuild(b *buildRecord, final bool) (*gateVerdict, error) {
+	verdict, err := evaluateQualityGates(b, final)
+	if err != nil {
+		return nil, err
+	}
+	_, err = updateBuildRecord(b.Org, b.App, b.Branch, b.Build, func(record *buildRecord) {
+		record.Verdict = verdict
+	})
+	if err != nil {
+		return nil, err
+	}
+	return verdict, nil
+}
+
+// baselineExclusion makes sure a master build isn't compared against itself
+func (b *buildRecord) baselineExclusion() string {
+	if b.Branch == baselineBranch {
+		return b.Build
+	}
+	return ""
+}
+
+func (gates *qualityGates) evaluate(b *buildRecord, baseline *buildRecord, final bool) *gateVerdict {
+	verdict := &gateVerdict{Final: final, Gates: []gateResult{}, EvaluatedAt: time.Now().UTC()}
+	if baseline != nil {
+		verdict.Baseline = fmt.Sprintf("%s #%s", baseline.Branch, baseline.Build)
+	}
+	missing := gatePending
+	if final {
+		missing = gateFailed
+	}
+	totals := b.testTotals()
+	coverage := b.coverage()
+
+	if gates.MinPassRate != nil {
+		result := gateResult{Name: "minPassRate", Threshold: fmt.Sprintf("%.2f%%", *gates.MinPassRate)}
+		if totals == nil || totals.Tests == totals.Skipped {
+			result.Status, result.Message = missing, "no tests reported"
+		} else {
+			rate := 100 * float64(totals.Passed) / float64(totals.Tests-totals.Skipped)
+			result.Actual = fmt.Sprintf("%.2f%%", rate)
+			result.Status = gateStatus(rate >= *gates.MinPassRate)
+		}
+		verdict.Gates = append(verdict.Gates, result)
+	}
+	if gates.NoNewFailures {
+		result := gateResult{Name: "noNewFailures", Threshold: "0"}
+		if baseline == nil {
+			result.Status, result.Message = gatePassed, fmt.Sprintf("no %s baseline", baselineBranch)
+		} else {
+			known := map[string]bool{}
+			for _, name := range baseline.failedTests() {
+				known[name] = true
+			}
+			var newFailures []string
+			for _, name := range b.failedTests() {
+				if !known[name] {
+					newFailures = append(newFailures, name)
+				}
+			}
+			result.Actual = strconv.Itoa(len(newFailures))
+			result.Status = gateStatus(len(newFailures) == 0)
+			if len(newFailures) > 0 {
+				result.Message = fmt.Sprintf("new failures: %s", joinLimited(newFailures, 10))
+			}
+		}
+		verdict.Gates = append(verdict.Gates, result)
+	}
+	if gates.MinCoverage != nil {
+		result := gateResult{Name: "minCoverage", Threshold: fmt.Sprintf("%.2f%%", *gates.MinCoverage)}
+		if coverage == nil {
+			result.Status, result.Message = missing, "no coverage reported"
+		} else {
+			result.Actual = fmt.Sprintf("%.2f%%", coverage.Percent)
+			result.Status = gateStatus(coverage.Percent >= *gates.MinCoverage)
+		}
+		verdict.Gates = append(verdict.Gates, result)
+	}
+	if gates.MaxCoverageDrop != nil {
+		result := gateResult{Name: "maxCoverageDrop", Threshold: fmt.Sprintf("%.2f%%", *gates.MaxCoverageDrop)}
+		var baselineCoverage *coverageResult
+		if baseline != nil {
+			baselineCoverage = baseline.coverage()
+		}
+		switch {
+		case baselineCoverage == nil:
+			result.Status, result.Message = gatePassed, fmt.Sprintf("no %s baseline coverage", baselineBranch)
+		case coverage == nil:
+			result.Status, result.Message = missing, "no coverage reported"
+		default:
+			drop := baselineCoverage.Percent - coverage.Percent
+			result.Actual = fmt.Sprintf("%.2f%%", drop)
+			result.Status = gateStatus(drop <= *gates.MaxCoverageDrop)
+		}
+		verdict.Gates = append(verdict.Gates, result)
+	}
+	if gates.MaxCriticalFindings != nil {
+		result := gateResult{Name: "maxCriticalFindings", Threshold: strconv.Itoa(*gates.MaxCriticalFindings)}
+		critical := b.findings()[severityCritical]
+		result.Actual = strconv.Itoa(critical)
+		result.Status = gateStatus(critical <= *gates.MaxCriticalFindings)
+		verdict.Gates = append(verdict.Gates, result)
+	}
+
+	verdict.Status = gatePassed
+	for _, result := range verdict.Gates {
+		if result.Status == gateFailed {
+			verdict.Status = gateFailed
+			break
+		}
+		if result.Status == gatePending {
+			verdict.Status = gatePending
+		}
+	}
+	return verdict
+}
+
+func gateStatus(passed bool) string {
+	if passed {
+		return gatePassed
+	}
+	return gateFailed
+}
+
+// failedGates returns the gates which didn't pass
+func (verdict *gateVerdict) failedGates() []gateResult {
+	var answer []gateResult
+	for _, result := range verdict.Gates {
+		if result.Status == gateFailed {
+			answer = append(answer, result)
+		}
+	}
+	return answer
+}
+
+func joinLimited(values []string, max int) string {
+	if len(values) <= max {
+		return fmt.Sprint(values)
+	}
+	return fmt.Sprintf("%v and %d more", values[:max], len(values)-max)
+}
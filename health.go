@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// the optional readiness checks, storage is always checked
+var (
+	flagReadyKubernetes = os.Getenv("READY_CHECK_KUBERNETES") == "true"
+	flagReadySinks      = os.Getenv("READY_CHECK_SINKS") == "true"
+)
+
+// sinkPinger is implemented by sinks that can tell whether the store they send to is reachable
+type sinkPinger interface {
+	Ping() error
+}
+
+// healthHandler tells whether the process is alive, it serves as long as the listeners do
+func healthHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+}
+
+// readyHandler tells whether the process can take uploads, reporting the outcome of every check
+func readyHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]string{}
+		ready := true
+		check := func(name string, err error) {
+			checks[name] = "OK"
+			if err != nil {
+				checks[name] = err.Error()
+				ready = false
+			}
+		}
+		check("reports", checkWritable(uploadPath))
+		check("data", checkWritable(dataPath))
+		if flagReadyKubernetes {
+			_, err := kubernetesClient.Discovery().ServerVersion()
+			check("kubernetes", err)
+		}
+		if flagReadySinks {
+			for _, worker := range sinkWorkers {
+				if pinger, ok := worker.sink.(sinkPinger); ok {
+					check(worker.sink.Name(), pinger.Ping())
+				}
+			}
+		}
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		renderJSON(w, map[string]interface{}{
+			"ready":  ready,
+			"checks": checks,
+		}, status)
+	})
+}
+
+// checkWritable makes sure files can be created in dir
+func checkWritable(dir string) error {
+	err := os.MkdirAll(dir, os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".ready-")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// shutdownTimeout leaves a second of the pod's termination grace period for the process to exit
+func shutdownTimeout() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("TERMINATION_GRACE_PERIOD_SECONDS"))
+	if err != nil || seconds < 2 {
+		seconds = 10
+	}
+	return time.Duration(seconds-1) * time.Second
+}
+
+// serve runs the servers until one of them fails, which exits the process, or until SIGTERM or SIGINT, which shuts
+// them down gracefully: in-flight requests are finished and queued documents sent to the sinks, as long as that
+// takes less than the termination grace period
+func serve(servers ...*http.Server) {
+	failed := make(chan error, len(servers))
+	for _, server := range servers {
+		go func(server *http.Server) {
+			err := server.ListenAndServe()
+			if err != http.ErrServerClosed {
+				failed <- err
+			}
+		}(server)
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case err := <-failed:
+		log.Fatalf("Server failed: %s\n", err)
+	case sig := <-signals:
+		log.Printf("Received %s, shutting down\n", sig)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			// uploads still running may yet queue documents, so the queues can't be closed
+			log.Printf("Failed to shut down %s: %s\n", server.Addr, err)
+			return
+		}
+	}
+	drained := make(chan struct{})
+	go func() {
+		stopIndexSinks()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		log.Println("Shut down")
+	case <-ctx.Done():
+		log.Println("Shut down before every queued document was sent")
+	}
+}
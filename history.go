@@ -0,0 +1,260 @@
+package main
+
+import (
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	"io/ioutil"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxTestHistory is the number of outcomes kept per test and branch
+const maxTestHistory = 50
+
+var historyLock sync.Mutex
+
+// testOutcome is the result of one test case in one build
+type testOutcome struct {
+	Build     string    `json:"build"`
+	Version   string    `json:"version"`
+	CommitSHA string    `json:"commitSHA,omitempty"`
+	Status    string    `json:"status"`
+	Time      float64   `json:"time"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// testHistory holds the outcomes of every test of an app on a single branch, oldest first
+type testHistory struct {
+	Org    string                   `json:"org"`
+	App    string                   `json:"app"`
+	Branch string                   `json:"branch"`
+	Tests  map[string][]testOutcome `json:"tests"`
+}
+
+// flakyTest describes a test that has both passed and failed against the same commit
+type flakyTest struct {
+	Name          string  `json:"name"`
+	Branch        string  `json:"branch"`
+	Score         float64 `json:"score"`
+	Flips         int     `json:"flips"`
+	Runs          int     `json:"runs"`
+	LastStatus    string  `json:"lastStatus"`
+	LastBuild     string  `json:"lastBuild"`
+	LastCommitSHA string  `json:"lastCommitSHA,omitempty"`
+}
+
+func historyDir(org string, app string) string {
+	return filepath.Join(appDataPath(org, app), "history", org, app)
+}
+
+func historyFile(org string, app string, branch string) string {
+	return filepath.Join(historyDir(org, app), storeKey(branch)+".json")
+}
+
+// loadTestHistory returns the test history of an app's branch, which is empty if nothing has been recorded yet
+func loadTestHistory(org string, app string, branch string) (*testHistory, error) {
+	h := &testHistory{Org: org, App: app, Branch: branch}
+	err := readJSON(historyFile(org, app, branch), h)
+	if err != nil {
+		return nil, err
+	}
+	if h.Tests == nil {
+		h.Tests = map[string][]testOutcome{}
+	}
+	return h, nil
+}
+
+// loadAppTestHistories returns the test history of every branch of an app
+func loadAppTestHistories(org string, app string) ([]*testHistory, error) {
+	files, err := ioutil.ReadDir(historyDir(org, app))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var answer []*testHistory
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		branch, err := neturl.PathUnescape(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil {
+			continue
+		}
+		h, err := loadTestHistory(org, app, branch)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, h)
+	}
+	return answer, nil
+}
+
+// recordTestOutcomes adds the outcomes of a build to the branch history. Outcomes already recorded for the same
+// build are replaced so that re-uploading a report doesn't count twice.
+func recordTestOutcomes(org string, app string, branch string, outcomes map[string]testOutcome) (*testHistory, error) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	h, err := loadTestHistory(org, app, branch)
+	if err != nil {
+		return nil, err
+	}
+	for name, outcome := range outcomes {
+		previous := h.Tests[name]
+		replaced := false
+		for i := range previous {
+			if previous[i].Build == outcome.Build {
+				previous[i] = outcome
+				replaced = true
+			}
+		}
+		if !replaced {
+			previous = append(previous, outcome)
+		}
+		if len(previous) > maxTestHistory {
+			previous = previous[len(previous)-maxTestHistory:]
+		}
+		h.Tests[name] = previous
+	}
+	err = writeJSON(historyFile(org, app, branch), h)
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// flakiness scores how often a test flips between passing and failing across builds of the same commit. The score
+// is the number of flips over the number of consecutive runs of the same commit, so 0 means stable and 1 means the
+// result changed on every re-run.
+func flakiness(outcomes []testOutcome) (score float64, flips int, pairs int) {
+	last := map[string]string{}
+	for _, o := range outcomes {
+		if o.CommitSHA == "" || o.Status == testStatusSkipped {
+			continue
+		}
+		previous, ok := last[o.CommitSHA]
+		last[o.CommitSHA] = o.Status
+		if !ok {
+			continue
+		}
+		pairs++
+		if isFailure(previous) != isFailure(o.Status) {
+			flips++
+		}
+	}
+	if pairs == 0 {
+		return 0, 0, 0
+	}
+	return float64(flips) / float64(pairs), flips, pairs
+}
+
+// flakyTests returns the flaky tests of a branch history, most flaky first
+func (h *testHistory) flakyTests() []flakyTest {
+	var answer []flakyTest
+	for name, outcomes := range h.Tests {
+		if ft, ok := h.flakyTest(name, outcomes); ok {
+			answer = append(answer, ft)
+		}
+	}
+	sortFlakyTests(answer)
+	return answer
+}
+
+func (h *testHistory) flakyTest(name string, outcomes []testOutcome) (flakyTest, bool) {
+	score, flips, _ := flakiness(outcomes)
+	if flips == 0 {
+		return flakyTest{}, false
+	}
+	last := outcomes[len(outcomes)-1]
+	return flakyTest{
+		Name:          name,
+		Branch:        h.Branch,
+		Score:         score,
+		Flips:         flips,
+		Runs:          len(outcomes),
+		LastStatus:    last.Status,
+		LastBuild:     last.Build,
+		LastCommitSHA: last.CommitSHA,
+	}, true
+}
+
+// flakyFailures returns the tests that failed in the given outcomes and are known to be flaky on the branch
+func (h *testHistory) flakyFailures(outcomes map[string]testOutcome) []flakyTest {
+	var answer []flakyTest
+	for name, outcome := range outcomes {
+		if !isFailure(outcome.Status) {
+			continue
+		}
+		if ft, ok := h.flakyTest(name, h.Tests[name]); ok {
+			answer = append(answer, ft)
+		}
+	}
+	sortFlakyTests(answer)
+	return answer
+}
+
+func sortFlakyTests(tests []flakyTest) {
+	sort.Slice(tests, func(i, j int) bool {
+		if tests[i].Score != tests[j].Score {
+			return tests[i].Score > tests[j].Score
+		}
+		if tests[i].Name != tests[j].Name {
+			return tests[i].Name < tests[j].Name
+		}
+		return tests[i].Branch < tests[j].Branch
+	})
+}
+
+// junitOutcomes extracts the outcome of every test case in a set of suites
+func junitOutcomes(suites []junitTestSuite, buildNo string, version string, commitSHA string) map[string]testOutcome {
+	now := time.Now().UTC()
+	outcomes := map[string]testOutcome{}
+	for _, s := range suites {
+		for _, tc := range s.TestCases {
+			id := tc.ID(s.Name)
+			if existing, ok := outcomes[id]; ok && isFailure(existing.Status) {
+				// parameterised tests share an ID, a single failing run fails the test
+				continue
+			}
+			outcomes[id] = testOutcome{
+				Build:     buildNo,
+				Version:   version,
+				CommitSHA: commitSHA,
+				Status:    tc.Status(),
+				Time:      tc.Duration(),
+				Timestamp: now,
+			}
+		}
+	}
+	return outcomes
+}
+
+// trackTestOutcomes records the outcome of every test in a JUnit report against the branch history and adds the
+// failures that are known to be flaky and the tests that slowed down to the upload result
+func trackTestOutcomes(data []byte, org string, app string, version string, buildNo string, branch string, pa *jenkinsxv1.PipelineActivity, result *uploadResult) error {
+	suites, err := parseJUnit(data)
+	if err != nil {
+		return err
+	}
+	// a flip is only meaningful against the same code, so outcomes are tied to the commit that was built
+	commitSHA := ""
+	if pa != nil {
+		commitSHA = pa.Spec.LastCommitSHA
+	}
+	outcomes := junitOutcomes(suites, buildNo, version, commitSHA)
+	h, err := recordTestOutcomes(org, app, branch, outcomes)
+	if err != nil {
+		return err
+	}
+	result.FlakyFailures = h.flakyFailures(outcomes)
+	if flagPerformanceRegressions {
+		result.PerformanceRegressions = h.durationRegressions(outcomes)
+	}
+	return nil
+}
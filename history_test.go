@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+)
+
+func outcomes(commitsAndStatuses ...string) []testOutcome {
+	var answer []testOutcome
+	for i := 0; i+1 < len(commitsAndStatuses); i += 2 {
+		answer = append(answer, testOutcome{CommitSHA: commitsAndStatuses[i], Status: commitsAndStatuses[i+1]})
+	}
+	return answer
+}
+
+func TestFlakiness(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		outcomes []testOutcome
+		score    float64
+		flips    int
+		pairs    int
+	}{
+		{"no runs", nil, 0, 0, 0},
+		{"single run", outcomes("a", testStatusFailed), 0, 0, 0},
+		{"stable across commits", outcomes("a", testStatusPassed, "b", testStatusFailed, "c", testStatusPassed), 0, 0, 0},
+		{"stable re-runs", outcomes("a", testStatusPassed, "a", testStatusPassed), 0, 0, 1},
+		{"flip on re-run", outcomes("a", testStatusFailed, "a", testStatusPassed), 1, 1, 1},
+		{"error counts as failure", outcomes("a", testStatusError, "a", testStatusFailed, "a", testStatusPassed), 0.5, 1, 2},
+		{"skipped runs are ignored", outcomes("a", testStatusPassed, "a", testStatusSkipped, "a", testStatusPassed), 0, 0, 1},
+		{"runs without a commit are ignored", outcomes("", testStatusPassed, "", testStatusFailed), 0, 0, 0},
+		{"interleaved commits", outcomes("a", testStatusPassed, "b", testStatusPassed, "a", testStatusFailed,
+			"b", testStatusPassed, "a", testStatusPassed), 2.0 / 3.0, 2, 3},
+	} {
+		score, flips, pairs := flakiness(test.outcomes)
+		if score != test.score || flips != test.flips || pairs != test.pairs {
+			t.Errorf("%s: got score %v, %d flips, %d pairs, expected %v, %d, %d", test.name, score, flips, pairs,
+				test.score, test.flips, test.pairs)
+		}
+	}
+}
+
+func TestFlakyFailures(t *testing.T) {
+	h := &testHistory{Branch: "master", Tests: map[string][]testOutcome{
+		"flaky":  outcomes("a", testStatusPassed, "a", testStatusFailed),
+		"broken": outcomes("a", testStatusFailed, "b", testStatusFailed),
+	}}
+	failures := h.flakyFailures(map[string]testOutcome{
+		"flaky":  {Status: testStatusFailed},
+		"broken": {Status: testStatusFailed},
+	})
+	if len(failures) != 1 || failures[0].Name != "flaky" || failures[0].Score != 1 {
+		t.Errorf("expected only the flaky test with a score of 1, got %+v", failures)
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the kinds of documents in the index
+const (
+	docKindSuite    = "suite"
+	docKindTestCase = "testcase"
+	docKindCoverage = "coverage"
+	docKindFinding  = "finding"
+)
+
+// indexDocument is a single suite, test case, coverage result or finding extracted from an uploaded report. Only
+// the fields of its kind are set.
+type indexDocument struct {
+	ID        string          `json:"id"`
+	Kind      string          `json:"kind"`
+	Org       string          `json:"org"`
+	App       string          `json:"app"`
+	Version   string          `json:"version"`
+	Branch    string          `json:"branch"`
+	Build     string          `json:"build"`
+	File      string          `json:"file"`
+	CommitSHA string          `json:"commitSHA,omitempty"`
+	BuildTime time.Time       `json:"buildTime"`
+	Timestamp time.Time       `json:"timestamp"`
+	Suite     string          `json:"suite,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Classname string          `json:"classname,omitempty"`
+	Status    string          `json:"status,omitempty"`
+	Duration  float64         `json:"duration,omitempty"`
+	Message   string          `json:"message,omitempty"`
+	Tests     *testTotals     `json:"tests,omitempty"`
+	Coverage  *coverageResult `json:"coverage,omitempty"`
+	Severity  string          `json:"severity,omitempty"`
+	Rule      string          `json:"rule,omitempty"`
+	Location  string          `json:"location,omitempty"`
+}
+
+// indexQuery selects documents of an app, empty fields match everything
+type indexQuery struct {
+	Kind    string
+	Version string
+	Branch  string
+	Build   string
+	Status  string
+	Text    string
+}
+
+// buildTrend is the outcome of one build as recorded in the index
+type buildTrend struct {
+	Version   string          `json:"version"`
+	Branch    string          `json:"branch"`
+	Build     string          `json:"build"`
+	CommitSHA string          `json:"commitSHA,omitempty"`
+	Timestamp time.Time       `json:"timestamp"`
+	Tests     *testTotals     `json:"tests,omitempty"`
+	Coverage  *coverageResult `json:"coverage,omitempty"`
+	Findings  map[string]int  `json:"findings,omitempty"`
+}
+
+func indexDir(org string, app string) string {
+	return filepath.Join(appDataPath(org, app), "index", org, storeKey(app))
+}
+
+// indexFile holds the documents of one report, so uploading the report again replaces them
+func indexFile(org string, app string, branch string, buildNo string, name string) string {
+	return filepath.Join(indexDir(org, app), storeKey(branch), storeKey(buildNo), storeKey(name)+".json")
+}
+
+// indexReport stores the documents of an uploaded report in the local index, returning them along with the
+// documents of an earlier upload of the report that they don't replace, e.g. of test cases that are gone
+func indexReport(b *buildRecord, report *buildReport, data []byte) ([]indexDocument, []indexDocument, error) {
+	docs, err := newIndexDocuments(b, report, data)
+	if err != nil {
+		return nil, nil, err
+	}
+	path := indexFile(b.Org, b.App, b.Branch, b.Build, report.Name)
+	var previous []indexDocument
+	err = readJSON(path, &previous)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids := map[string]bool{}
+	for _, doc := range docs {
+		ids[doc.ID] = true
+	}
+	var stale []indexDocument
+	for _, doc := range previous {
+		if !ids[doc.ID] {
+			stale = append(stale, doc)
+		}
+	}
+	if len(docs) == 0 {
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return docs, stale, err
+	}
+	return docs, stale, writeJSON(path, docs)
+}
+
+// newIndexDocuments extracts the documents of a report of a recognised type
+func newIndexDocuments(b *buildRecord, report *buildReport, data []byte) ([]indexDocument, error) {
+	doc := indexDocument{
+		Org:       b.Org,
+		App:       b.App,
+		Version:   b.Version,
+		Branch:    b.Branch,
+		Build:     b.Build,
+		File:      report.Name,
+		BuildTime: b.Created,
+		Timestamp: report.Uploaded,
+	}
+	if b.Activity != nil {
+		doc.CommitSHA = b.Activity.LastCommitSHA
+	}
+	var docs []indexDocument
+	switch report.ContentType {
+	case contentTypeJUnit:
+		suites, err := parseJUnit(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range suites {
+			suite := doc
+			suite.Kind = docKindSuite
+			suite.Suite = s.Name
+			totals := &buildReport{}
+			totals.addTests([]junitTestSuite{s})
+			suite.Tests = totals.Tests
+			docs = append(docs, suite)
+			for _, tc := range s.TestCases {
+				test := doc
+				test.Kind = docKindTestCase
+				test.Suite = s.Name
+				test.Name = tc.Name
+				test.Classname = tc.Classname
+				test.Status = tc.Status()
+				test.Duration = tc.Duration()
+				for _, result := range []*junitResult{tc.Failure, tc.Error, tc.Skipped} {
+					if result != nil {
+						test.Message = result.Message
+					}
+				}
+				docs = append(docs, test)
+			}
+		}
+	case contentTypeCobertura, contentTypeJaCoCo:
+		if report.Coverage != nil {
+			coverage := doc
+			coverage.Kind = docKindCoverage
+			coverage.Coverage = report.Coverage
+			docs = append(docs, coverage)
+		}
+	case contentTypeSARIF:
+		results, err := parseSARIFResults(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, result := range results {
+			finding := doc
+			finding.Kind = docKindFinding
+			finding.Severity = result.severity()
+			finding.Rule = result.RuleID
+			finding.Message = result.Message.Text
+			finding.Location = result.location()
+			docs = append(docs, finding)
+		}
+	}
+	assignDocumentIDs(docs)
+	return docs, nil
+}
+
+// assignDocumentIDs derives the ID of every document from what it is, so indexing a report again, be it a retry or
+// the same file uploaded again, overwrites its documents rather than adding duplicates. Documents that would get
+// the same ID, e.g. the runs of a parameterised test, are told apart by the order they appear in.
+func assignDocumentIDs(docs []indexDocument) {
+	seen := map[string]int{}
+	for i := range docs {
+		doc := &docs[i]
+		key := strings.Join([]string{doc.Org, doc.App, doc.Version, doc.Branch, doc.Build, doc.File, doc.Kind,
+			doc.Suite, doc.Classname, doc.Name, doc.Rule, doc.Location}, "\x00")
+		n := seen[key]
+		seen[key] = n + 1
+		doc.ID = fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%s\x00%d", key, n))))
+	}
+}
+
+// reindex rebuilds the local index from the stored build records and report files of every team and sends every
+// document to the sinks again, e.g. after a change to the index mapping
+func reindex() error {
+	for _, root := range teamRoots(dataPath) {
+		err := reindexBuilds(filepath.Join(root, "builds"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func reindexBuilds(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || !strings.HasSuffix(info.Name(), ".json") {
+			return nil
+		}
+		b := &buildRecord{}
+		err = readJSON(path, b)
+		if err != nil {
+			return err
+		}
+		for _, report := range b.sortedReports() {
+			data, err := readStoredFile(filepath.Join(appUploadPath(b.Org, b.App), b.Org, b.App, b.Version, report.Name))
+			if os.IsNotExist(err) {
+				log.Printf("Skipping %s of %s, the file is gone\n", report.Name, path)
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			docs, stale, err := indexReport(b, report, data)
+			if err != nil {
+				log.Printf("Skipping %s of %s: %s\n", report.Name, path, err)
+				continue
+			}
+			// every document has to get to the sinks this time, so wait for room in their queues
+			waitToFeedIndexSinks(docs, stale)
+		}
+		return nil
+	})
+}
+
+// indexCache keeps the documents of every index file that has been read, so only files changed since are read
+// again. Entries are dropped when their file is gone.
+var indexCache = map[string]*cachedIndexFile{}
+var indexCacheLock sync.Mutex
+
+type cachedIndexFile struct {
+	modTime time.Time
+	size    int64
+	docs    []indexDocument
+}
+
+// queryIndex returns the documents of an app matching the query, most recent first. The local index keeps a file
+// per report, under a directory per branch and build, and only the directories of the branch and build of the query
+// are walked. A query across every branch still looks at every file of the app, though unchanged files are served
+// from memory, so searches and trends slow down with the history of the app. Retention keeps that in check, apps
+// with long histories are better searched through the Elasticsearch sink.
+func queryIndex(org string, app string, q indexQuery) ([]indexDocument, error) {
+	root := indexDir(org, app)
+	if q.Branch != "" {
+		root = filepath.Join(root, storeKey(q.Branch))
+		if q.Build != "" {
+			root = filepath.Join(root, storeKey(q.Build))
+		}
+	}
+	indexCacheLock.Lock()
+	defer indexCacheLock.Unlock()
+	seen := map[string]bool{}
+	docs := []indexDocument{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".") || !strings.HasSuffix(info.Name(), ".json") {
+			return nil
+		}
+		seen[path] = true
+		cached := indexCache[path]
+		if cached == nil || !cached.modTime.Equal(info.ModTime()) || cached.size != info.Size() {
+			cached = &cachedIndexFile{modTime: info.ModTime(), size: info.Size()}
+			err = readJSON(path, &cached.docs)
+			if err != nil {
+				return err
+			}
+			indexCache[path] = cached
+		}
+		for i := range cached.docs {
+			if q.matches(&cached.docs[i]) {
+				docs = append(docs, cached.docs[i])
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	prefix := root + string(filepath.Separator)
+	for path := range indexCache {
+		if strings.HasPrefix(path, prefix) && !seen[path] {
+			delete(indexCache, path)
+		}
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i].Timestamp.After(docs[j].Timestamp)
+	})
+	return docs, nil
+}
+
+func (q *indexQuery) matches(doc *indexDocument) bool {
+	if (q.Kind != "" && doc.Kind != q.Kind) || (q.Version != "" && doc.Version != q.Version) ||
+		(q.Branch != "" && doc.Branch != q.Branch) || (q.Build != "" && doc.Build != q.Build) {
+		return false
+	}
+	if q.Status != "" && (doc.Kind != docKindTestCase || !matchesStatusFilter(doc.Status, q.Status)) {
+		return false
+	}
+	if q.Text == "" {
+		return true
+	}
+	text := strings.ToLower(q.Text)
+	for _, field := range []string{doc.Name, doc.Classname, doc.Suite, doc.Message, doc.Rule, doc.Location} {
+		if strings.Contains(strings.ToLower(field), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexTrends rebuilds the outcome of every build from its suite, coverage and finding documents, oldest first
+func indexTrends(docs []indexDocument) []*buildTrend {
+	records := map[string]*buildRecord{}
+	trends := map[string]*buildTrend{}
+	for _, doc := range docs {
+		key := buildKey(doc.Branch, doc.Build)
+		b := records[key]
+		if b == nil {
+			b = &buildRecord{Reports: map[string]*buildReport{}}
+			records[key] = b
+			trends[key] = &buildTrend{Version: doc.Version, Branch: doc.Branch, Build: doc.Build}
+		}
+		trend := trends[key]
+		if doc.Timestamp.After(trend.Timestamp) {
+			trend.Timestamp = doc.Timestamp
+			trend.Version = doc.Version
+		}
+		if doc.CommitSHA != "" {
+			trend.CommitSHA = doc.CommitSHA
+		}
+		report := b.Reports[doc.File]
+		if report == nil {
+			report = &buildReport{Name: doc.File}
+			b.Reports[doc.File] = report
+		}
+		switch doc.Kind {
+		case docKindSuite:
+			if report.Tests == nil {
+				report.Tests = &testTotals{}
+			}
+			report.Tests.Tests += doc.Tests.Tests
+			report.Tests.Passed += doc.Tests.Passed
+			report.Tests.Failures += doc.Tests.Failures
+			report.Tests.Errors += doc.Tests.Errors
+			report.Tests.Skipped += doc.Tests.Skipped
+			report.Tests.Time += doc.Tests.Time
+		case docKindCoverage:
+			report.Coverage = doc.Coverage
+		case docKindFinding:
+			if report.Findings == nil {
+				report.Findings = map[string]int{}
+			}
+			report.Findings[doc.Severity]++
+		}
+	}
+	answer := []*buildTrend{}
+	for key, trend := range trends {
+		trend.Tests = records[key].testTotals()
+		trend.Coverage = records[key].coverage()
+		trend.Findings = records[key].findings()
+		answer = append(answer, trend)
+	}
+	sort.Slice(answer, func(i, j int) bool {
+		return answer[i].Timestamp.Before(answer[j].Timestamp)
+	})
+	return answer
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reportChecksum is the SHA-256 of a report file as it was uploaded, recorded in the manifest of its version
+type reportChecksum struct {
+	SHA256   string    `json:"sha256"`
+	Uploaded time.Time `json:"uploaded"`
+}
+
+// sha256 returns the checksum, or nothing if none was recorded
+func (c *reportChecksum) sha256() string {
+	if c == nil {
+		return ""
+	}
+	return c.SHA256
+}
+
+// supersedes tells whether the report was uploaded again after a build uploaded it, by the same build or another
+func (c *reportChecksum) supersedes(report *buildReport) bool {
+	return c != nil && c.Uploaded.After(report.Uploaded)
+}
+
+// errChecksumMismatch is returned when an uploaded report doesn't match the checksum sent along with it
+type errChecksumMismatch struct {
+	header   string
+	expected string
+	actual   string
+}
+
+func (e *errChecksumMismatch) Error() string {
+	return fmt.Sprintf("upload doesn't match its %s, expected %s but got %s", e.header, e.expected, e.actual)
+}
+
+// verifyUploadChecksums checks the uploaded file against the X-Content-MD5 and X-Checksum-Sha256 headers, if the
+// uploader sent any, and returns its SHA-256. Both are checksums of the file part of the form rather than of the
+// request body, which is why the standard Content-MD5 header isn't used. Either may be hex or base64 encoded.
+func verifyUploadChecksums(r *http.Request, data []byte) (string, error) {
+	md5Sum := md5.Sum(data)
+	sha256Sum := sha256.Sum256(data)
+	for _, check := range []struct {
+		header string
+		sum    []byte
+	}{
+		{"X-Content-MD5", md5Sum[:]},
+		{"X-Checksum-Sha256", sha256Sum[:]},
+	} {
+		value := strings.TrimSpace(r.Header.Get(check.header))
+		if value == "" {
+			continue
+		}
+		expected, err := decodeChecksum(value, len(check.sum))
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("invalid %s %s: %s", check.header, value, err))
+		}
+		if hex.EncodeToString(expected) != hex.EncodeToString(check.sum) {
+			return "", &errChecksumMismatch{header: check.header, expected: hex.EncodeToString(expected),
+				actual: hex.EncodeToString(check.sum)}
+		}
+	}
+	return hex.EncodeToString(sha256Sum[:]), nil
+}
+
+func decodeChecksum(value string, size int) ([]byte, error) {
+	if len(value) == 2*size {
+		if sum, err := hex.DecodeString(value); err == nil {
+			return sum, nil
+		}
+	}
+	sum, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	if len(sum) != size {
+		return nil, errors.New(fmt.Sprintf("expected %d bytes, got %d", size, len(sum)))
+	}
+	return sum, nil
+}
+
+// integrityReport is the outcome of hashing the stored report files again and comparing them with the checksums
+// recorded when they were uploaded
+type integrityReport struct {
+	OK       bool      `json:"ok"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	Checked  int       `json:"checked"`
+	// Unrecorded counts the report files uploaded before checksums were recorded, which can't be verified
+	Unrecorded int                 `json:"unrecorded"`
+	Mismatches []*integrityFailure `json:"mismatches,omitempty"`
+}
+
+// integrityFailure is a report file that is missing, can't be read or doesn't match its checksum any more
+type integrityFailure struct {
+	Org      string `json:"org"`
+	App      string `json:"app"`
+	Version  string `json:"version"`
+	File     string `json:"file"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func newIntegrityReport() *integrityReport {
+	return &integrityReport{OK: true, Started: time.Now().UTC()}
+}
+
+func (report *integrityReport) finish() *integrityReport {
+	report.OK = len(report.Mismatches) == 0
+	report.Finished = time.Now().UTC()
+	return report
+}
+
+// verifyReports verifies every app of every org, or of one org if org isn't empty
+func verifyReports(org string) (*integrityReport, error) {
+	report := newIntegrityReport()
+	orgs := []string{org}
+	if org == "" {
+		var err error
+		orgs, err = listOrgs()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, o := range orgs {
+		apps, err := listApps(o)
+		if err != nil {
+			return nil, err
+		}
+		for _, app := range apps {
+			err = verifyApp(report, o, app, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return report.finish(), nil
+}
+
+// verifyApp hashes the report files of every version of an app, or of one version if version isn't empty, again
+func verifyApp(report *integrityReport, org string, app string, version string) error {
+	m, err := loadAppManifest(org, app)
+	if err != nil {
+		return err
+	}
+	for _, v := range m.sortedVersions() {
+		if version != "" && v.Version != version {
+			continue
+		}
+		names := make([]string, 0, len(v.Reports))
+		for name := range v.Reports {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			checksum := v.Checksums[name]
+			if checksum == nil {
+				report.Unrecorded++
+				continue
+			}
+			report.Checked++
+			failure := &integrityFailure{Org: org, App: app, Version: v.Version, File: name, Expected: checksum.SHA256}
+			data, err := readStoredFile(filepath.Join(appUploadPath(org, app), org, app, v.Version, name))
+			if os.IsNotExist(err) {
+				failure.Error = "missing"
+			} else if err != nil {
+				failure.Error = err.Error()
+			} else if actual := fmt.Sprintf("%x", sha256.Sum256(data)); actual != checksum.SHA256 {
+				failure.Actual = actual
+			} else {
+				continue
+			}
+			report.Mismatches = append(report.Mismatches, failure)
+		}
+	}
+	return nil
+}
+
+// integrityHandler verifies the report files of an app, or of the version given by the version parameter
+func integrityHandler(w http.ResponseWriter, r *http.Request, org string, app string) {
+	report := newIntegrityReport()
+	err := verifyApp(report, org, app, r.URL.Query().Get("version"))
+	if err != nil {
+		renderJSONError(w, "CANT_READ_MANIFEST", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	renderAPI(w, r, report.finish())
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerifyUploadChecksums(t *testing.T) {
+	data := []byte("<testsuite tests=\"1\"/>")
+	md5Sum, sha256Sum := md5.Sum(data), sha256.Sum256(data)
+	for _, test := range []struct {
+		name     string
+		headers  map[string]string
+		mismatch bool
+		invalid  bool
+	}{
+		{"no checksums", nil, false, false},
+		{"hex MD5", map[string]string{"X-Content-MD5": hex.EncodeToString(md5Sum[:])}, false, false},
+		{"base64 MD5", map[string]string{"X-Content-MD5": base64.StdEncoding.EncodeToString(md5Sum[:])}, false, false},
+		{"hex SHA-256", map[string]string{"X-Checksum-Sha256": hex.EncodeToString(sha256Sum[:])}, false, false},
+		{"base64 SHA-256", map[string]string{"X-Checksum-Sha256": base64.StdEncoding.EncodeToString(sha256Sum[:])},
+			false, false},
+		{"wrong MD5", map[string]string{"X-Content-MD5": hex.EncodeToString(sha256Sum[:16])}, true, false},
+		{"wrong SHA-256", map[string]string{"X-Content-MD5": hex.EncodeToString(md5Sum[:]),
+			"X-Checksum-Sha256": hex.EncodeToString(md5Sum[:]) + hex.EncodeToString(md5Sum[:])}, true, false},
+		{"undecodable", map[string]string{"X-Checksum-Sha256": "not a checksum"}, false, true},
+		{"short", map[string]string{"X-Content-MD5": base64.StdEncoding.EncodeToString(md5Sum[:8])}, false, true},
+		// the standard header is a checksum of the body, which isn't what is checked
+		{"body MD5", map[string]string{"Content-MD5": "bm90IHRoZSBmaWxlIGNoZWNrc3VtIQ=="}, false, false},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/junit.xml", nil)
+		for header, value := range test.headers {
+			r.Header.Set(header, value)
+		}
+		sum, err := verifyUploadChecksums(r, data)
+		_, mismatch := err.(*errChecksumMismatch)
+		if mismatch != test.mismatch || (err != nil && !mismatch) != test.invalid {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if err == nil && sum != hex.EncodeToString(sha256Sum[:]) {
+			t.Errorf("%s: expected the SHA-256 %x, got %s", test.name, sha256Sum, sum)
+		}
+	}
+}
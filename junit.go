@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	testStatusPassed  = "passed"
+	testStatusFailed  = "failed"
+	testStatusError   = "error"
+	testStatusSkipped = "skipped"
+)
+
+// junitTestSuites is the <testsuites> root element some tools wrap their suites in
+type junitTestSuites struct {
+	Suites []junitTestSuite `xml:"testsuite"`
+}
+
+// junitTestSuite is a single <testsuite>, which may itself contain nested suites
+type junitTestSuite struct {
+	Name      string           `xml:"name,attr"`
+	Tests     string           `xml:"tests,attr"`
+	Failures  string           `xml:"failures,attr"`
+	Errors    string           `xml:"errors,attr"`
+	Skipped   string           `xml:"skipped,attr"`
+	Time      string           `xml:"time,attr"`
+	Timestamp string           `xml:"timestamp,attr"`
+	TestCases []junitTestCase  `xml:"testcase"`
+	Suites    []junitTestSuite `xml:"testsuite"`
+	SystemOut string           `xml:"system-out"`
+	SystemErr string           `xml:"system-err"`
+}
+
+// junitTestCase is a single <testcase> of a suite
+type junitTestCase struct {
+	Name      string       `xml:"name,attr"`
+	Classname string       `xml:"classname,attr"`
+	Time      string       `xml:"time,attr"`
+	Failure   *junitResult `xml:"failure"`
+	Error     *junitResult `xml:"error"`
+	Skipped   *junitResult `xml:"skipped"`
+	SystemOut string       `xml:"system-out"`
+	SystemErr string       `xml:"system-err"`
+}
+
+// junitResult is the <failure>, <error> or <skipped> element of a test case
+type junitResult struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// parseJUnit reads a JUnit XML report, accepting either a <testsuites> or a <testsuite> root, and returns all
+// suites it contains with nested suites flattened
+func parseJUnit(data []byte) ([]junitTestSuite, error) {
+	root, err := xmlRootElement(data)
+	if err != nil {
+		return nil, err
+	}
+	var suites []junitTestSuite
+	switch root {
+	case "testsuites":
+		var s junitTestSuites
+		if err := xml.Unmarshal(data, &s); err != nil {
+			return nil, err
+		}
+		suites = s.Suites
+	case "testsuite":
+		var s junitTestSuite
+		if err := xml.Unmarshal(data, &s); err != nil {
+			return nil, err
+		}
+		suites = []junitTestSuite{s}
+	default:
+		return nil, errors.New(fmt.Sprintf("not a JUnit report, root element is <%s>", root))
+	}
+	return flattenSuites(suites), nil
+}
+
+func flattenSuites(suites []junitTestSuite) []junitTestSuite {
+	var answer []junitTestSuite
+	for _, s := range suites {
+		nested := s.Suites
+		s.Suites = nil
+		answer = append(answer, s)
+		answer = append(answer, flattenSuites(nested)...)
+	}
+	return answer
+}
+
+// xmlRootElement returns the local name of the first element in an XML document
+func xmlRootElement(data []byte) (string, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return "", errors.New("no root element found")
+		}
+		if err != nil {
+			return "", err
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			return start.Name.Local, nil
+		}
+	}
+}
+
+// ID returns the identifier used to track a test case across builds
+func (tc junitTestCase) ID(suite string) string {
+	if tc.Classname != "" {
+		return fmt.Sprintf("%s.%s", tc.Classname, tc.Name)
+	}
+	if suite != "" {
+		return fmt.Sprintf("%s.%s", suite, tc.Name)
+	}
+	return tc.Name
+}
+
+// Status returns one of the testStatus constants
+func (tc junitTestCase) Status() string {
+	switch {
+	case tc.Failure != nil:
+		return testStatusFailed
+	case tc.Error != nil:
+		return testStatusError
+	case tc.Skipped != nil:
+		return testStatusSkipped
+	}
+	return testStatusPassed
+}
+
+// Duration returns the test time in seconds
+func (tc junitTestCase) Duration() float64 {
+	return parseJUnitFloat(tc.Time)
+}
+
+// parseJUnitFloat leniently parses numeric attributes, as some tools write thousands separators
+func parseJUnitFloat(value string) float64 {
+	f, err := strconv.ParseFloat(strings.Replace(strings.TrimSpace(value), ",", "", -1), 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
+
+// isFailure returns true for both failed and errored tests
+func isFailure(status string) bool {
+	return status == testStatusFailed || status == testStatusError
+}
@@ -1,17 +1,13 @@
 package main
 
 import (
-	"bytes"
 	json2 "encoding/json"
-	"errors"
 	"fmt"
-	"github.com/clbanning/mxj"
-	"github.com/clbanning/mxj/x2j"
 	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
 	"github.com/jenkins-x/jx/pkg/client/clientset/versioned"
-	"io"
 	"io/ioutil"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
@@ -19,6 +15,8 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -27,14 +25,52 @@ const uploadPath = "/reports"
 const downloadPort = 8080
 const uploadPort = 8081
 const bind = "0.0.0.0"
-const url = "http://jenkins-x-reports-elasticsearch-client.jx:9200/tests/junit/"
 const cmNamespace = "jx"
+const dataPath = "/data"
+const reportsAnnotation = "jenkins-x-reports"
+// flagPerformanceRegressions reports tests that got significantly slower in the upload response
+var flagPerformanceRegressions = os.Getenv("FLAG_PERFORMANCE_REGRESSIONS") == "true"
+// reportsNamespace is where the jenkins-x-reports service runs, which is shared by every team
+var reportsNamespace = os.Getenv("POD_NAMESPACE")
 var kubernetesClient kubernetes.Interface
 var jenkinsClient versioned.Interface
 
 func main() {
 	var err error
 
+	// reindex rebuilds the index from the stored reports, e.g. kubectl exec <pod> -- /jenkins-x-reports reindex
+	if len(os.Args) > 1 && os.Args[1] == "reindex" {
+		startIndexSinks()
+		err = reindex()
+		stopIndexSinks()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// verify-attestation checks a downloaded attestation offline against the public key served on
+	// /api/v1/attestation-key, and the downloaded report files too if their directory is given, e.g.
+	// /jenkins-x-reports verify-attestation app-1.0.0.attestation.json key.pem reports/
+	if len(os.Args) > 1 && os.Args[1] == "verify-attestation" {
+		if len(os.Args) < 4 {
+			log.Fatal("usage: verify-attestation <attestation> <public key> [reports directory]")
+		}
+		dir := ""
+		if len(os.Args) > 4 {
+			dir = os.Args[4]
+		}
+		attested, err := verifyAttestationFile(os.Args[2], os.Args[3], dir)
+		if attested != nil {
+			data, _ := json2.MarshalIndent(attested, "", "  ")
+			fmt.Println(string(data))
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	kubernetesClient, err = createKubernetesClient()
 	if err != nil {
 		panic(err)
@@ -45,22 +81,64 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	go uploadServer()
-	downloadServer()
+
+	// gc applies the retention policy once and prints what it removed, e.g. /jenkins-x-reports gc --dry-run
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		policy := loadRetentionPolicy()
+		policy.DryRun = policy.DryRun || (len(os.Args) > 2 && os.Args[2] == "--dry-run")
+		startIndexSinks()
+		report, err := collectGarbage(policy)
+		stopIndexSinks()
+		if report != nil {
+			data, _ := json2.MarshalIndent(report, "", "  ")
+			fmt.Println(string(data))
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// verify hashes the stored report files again, e.g. /jenkins-x-reports verify myorg, and fails on any mismatch
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		org := ""
+		if len(os.Args) > 2 {
+			org = os.Args[2]
+		}
+		report, err := verifyReports(org)
+		if err != nil {
+			log.Fatal(err)
+		}
+		data, _ := json2.MarshalIndent(report, "", "  ")
+		fmt.Println(string(data))
+		if !report.OK {
+			os.Exit(1)
+		}
+		return
+	}
+	startIndexSinks()
+	startPruning()
+	startReleaseLinking()
+	go collectGarbagePeriodically(loadRetentionPolicy())
+	serve(downloadServer(), uploadServer())
 }
 
-func downloadServer() {
+func downloadServer() *http.Server {
 	server:= http.NewServeMux()
-	server.Handle("/", http.FileServer(http.Dir(uploadPath)))
+	server.Handle("/", authorizeReads(reportFileHandler()))
+	server.Handle(apiPrefix, authorizeReads(apiHandler()))
+	server.HandleFunc("/metrics", authorizeMetrics(metricsHandler()))
+	server.HandleFunc("/healthz", healthHandler())
+	server.HandleFunc("/readyz", readyHandler())
 	log.Printf("Download server listening on %s:%d\n", bind, downloadPort)
-	http.ListenAndServe(fmt.Sprintf("%s:%d", bind, downloadPort), server)
+	return &http.Server{Addr: fmt.Sprintf("%s:%d", bind, downloadPort), Handler: server}
 }
 
-func uploadServer() {
+func uploadServer() *http.Server {
 	server:= http.NewServeMux()
-	server.HandleFunc("/", uploadFileHandler())
+	server.HandleFunc("/", instrumentUploads(authenticateUploads(uploadFileHandler())))
+	server.HandleFunc("/finalize", authenticateUploads(finalizeBuildHandler()))
 	log.Printf("Upload server listening on %s:%d\n", bind, uploadPort)
-	http.ListenAndServe(fmt.Sprintf("%s:%d", bind, uploadPort), server)
+	return &http.Server{Addr: fmt.Sprintf("%s:%d", bind, uploadPort), Handler: server}
 }
 
 func uploadFileHandler() http.HandlerFunc {
@@ -69,28 +147,63 @@ func uploadFileHandler() http.HandlerFunc {
 		// Get and validate headers
 		org := r.Header.Get("X-Org")
 		if org == "" {
-			renderError(w, "MUST_PROVIDE_X-ORG_HEADER", http.StatusInternalServerError)
+			renderError(w, "MUST_PROVIDE_X-ORG_HEADER", http.StatusBadRequest)
 			log.Println("No X-Org HEADER provided")
+			return
 		}
 		app := r.Header.Get("X-App")
 		if app == "" {
-			renderError(w, "MUST_PROVIDE_X-APP_HEADER", http.StatusInternalServerError)
+			renderError(w, "MUST_PROVIDE_X-APP_HEADER", http.StatusBadRequest)
 			log.Println("No X-App HEADER provided")
+			return
 		}
 		version := r.Header.Get("X-Version")
 		if version == "" {
-			renderError(w, "MUST_PROVIDE_X-VERSION_HEADER", http.StatusInternalServerError)
+			renderError(w, "MUST_PROVIDE_X-VERSION_HEADER", http.StatusBadRequest)
 			log.Println("No X-Version HEADER provided")
+			return
 		}
 		buildNo := r.Header.Get("X-Build-Number")
 		if buildNo == "" {
-			renderError(w, "MUST_PROVIDE_X-BUILD-NUMBER_HEADER", http.StatusInternalServerError)
+			renderError(w, "MUST_PROVIDE_X-BUILD-NUMBER_HEADER", http.StatusBadRequest)
 			log.Println("No X-Build-Number provided")
+			return
 		}
 		branch := r.Header.Get("X-Branch")
 		if branch == "" {
-			renderError(w, "MUST_PROVIDE_X-BRANCH_HEADER", http.StatusInternalServerError)
+			renderError(w, "MUST_PROVIDE_X-BRANCH_HEADER", http.StatusBadRequest)
 			log.Println("No X-Branch provided")
+			return
+		}
+		err := checkUploadNames(r)
+		if err != nil {
+			renderError(w, "INVALID_NAME", http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+
+		// reports are stored, and ConfigMaps and PipelineActivities updated, for the team uploading
+		namespace, err := requestNamespace(r)
+		if err != nil {
+			renderError(w, "NAMESPACE_NOT_ALLOWED", http.StatusForbidden)
+			log.Println(err)
+			return
+		}
+		err = claimApp(org, app, namespace)
+		if err == errAppOfAnotherTeam {
+			renderError(w, "APP_BELONGS_TO_ANOTHER_TEAM", http.StatusForbidden)
+			log.Printf("%s/%s can't be uploaded to from namespace %s\n", org, app, namespace)
+			return
+		}
+		if err == errAppNotAssigned {
+			renderError(w, "APP_NOT_ASSIGNED_TO_TEAM", http.StatusForbidden)
+			log.Printf("%s/%s isn't assigned to the team of namespace %s\n", org, app, namespace)
+			return
+		}
+		if err != nil {
+			renderError(w, "CANT_CLAIM_APP", http.StatusInternalServerError)
+			log.Println(err)
+			return
 		}
 
 		// validate file size
@@ -116,46 +229,84 @@ func uploadFileHandler() http.HandlerFunc {
 			log.Println(err)
 			return
 		}
+		sum, err := verifyUploadChecksums(r, fileBytes)
+		if _, ok := err.(*errChecksumMismatch); ok {
+			checksumRejectionsTotal.add(1, org, app)
+			renderError(w, "CHECKSUM_MISMATCH", http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
+		if err != nil {
+			renderError(w, "INVALID_CHECKSUM", http.StatusBadRequest)
+			log.Println(err)
+			return
+		}
 		_, filename := filepath.Split(r.URL.Path)
-		dir := filepath.Join(uploadPath, org, app, version)
+		if strings.HasSuffix(filename, compressedSuffix) {
+			renderError(w, "RESERVED_FILE_NAME", http.StatusBadRequest)
+			log.Printf("%s ends with %s, which is reserved for compressed reports\n", filename, compressedSuffix)
+			return
+		}
+		dir := filepath.Join(appUploadPath(org, app), org, app, version)
 		newPath := filepath.Join(dir, filename)
+		storedName, storedBytes := compressReport(filename, fileBytes)
+		storedPath := filepath.Join(dir, storedName)
 
+		// check the quotas of the org and app before anything is written
+		quotaWarnings, err := reserveQuota(org, app, newPath, int64(len(storedBytes)))
+		if exceeded, ok := err.(*errQuotaExceeded); ok {
+			quotaRejectionsTotal.add(1, org, app)
+			renderError(w, exceeded.code(), http.StatusRequestEntityTooLarge)
+			log.Println(err)
+			return
+		}
+		if err != nil {
+			renderError(w, "CANT_CHECK_QUOTA", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
 		err = os.MkdirAll(dir, os.FileMode(0755))
 		if err != nil {
+			forgetUsage(org, app)
 			renderError(w, "CANT_CREATE_DIR", http.StatusInternalServerError)
 			log.Println(err)
 			return
 		}
-		// write file
-		newFile, err := os.Create(newPath)
+		// write file, identical uploads share the blob of their content
+		err = storeBlob(appUploadPath(org, app), storedPath, storedBytes)
+		if err == nil {
+			err = removeOtherVariant(newPath, storedPath)
+		}
 		if err != nil {
-			renderError(w, "CANT_WRITE_FILE", http.StatusInternalServerError)
+			forgetUsage(org, app)
+			if isStorageFull(err) {
+				renderError(w, "INSUFFICIENT_STORAGE", http.StatusInsufficientStorage)
+			} else {
+				renderError(w, "CANT_WRITE_FILE", http.StatusInternalServerError)
+			}
 			log.Println(err)
 			return
 		}
-		defer newFile.Close() // idempotent, okay to call twice
-		if _, err := newFile.Write(fileBytes); err != nil || newFile.Close() != nil {
-			renderError(w, "CANT_WRITE_FILE", http.StatusInternalServerError)
+		// the PipelineActivity ties the reports to a commit and a build, not every pipeline has one though
+		pa, err := getPipelineActivity(buildNo, branch, org, app)
+		if err != nil {
 			log.Println(err)
-			return
+			pa = nil
 		}
-		if r.Header.Get("X-Content-Type") == "text/vnd.junit-xml" {
-			reader, err := os.Open(newPath)
-			if err != nil {
-				renderError(w, "CANT_READ_FILE", http.StatusInternalServerError)
-				log.Println(err)
-			}
-			err = sendToElasticSearch(reader, org, app, version, r.URL.Path)
+		result := &uploadResult{Status: "SUCCESS", QuotaWarnings: quotaWarnings}
+		report := &buildReport{Name: filename, ContentType: r.Header.Get("X-Content-Type"), Uploaded: time.Now().UTC(),
+			SHA256: sum}
+		// extracting results is best effort, the report itself has been stored
+		err = analyseReport(report, fileBytes)
+		if err != nil {
+			log.Println(err)
+		}
+		if report.ContentType == contentTypeJUnit {
+			err = trackTestOutcomes(fileBytes, org, app, version, buildNo, branch, pa, result)
 			if err != nil {
-				renderError(w, "CANT_SEND_TO_ELASTICSEATCH", http.StatusInternalServerError)
 				log.Println(err)
 			}
 		}
-		cm, err := getOrCreateConfigMap(org, app)
-		if err != nil {
-			renderError(w, "ERROR_CREATING_CONFIG_MAP", http.StatusInternalServerError)
-			log.Println(err)
-		}
 		reportHost, err := getReportHost()
 		if err != nil {
 			renderError(w, "ERROR_CREATING_CONFIG_MAP", http.StatusInternalServerError)
@@ -163,85 +314,56 @@ func uploadFileHandler() http.HandlerFunc {
 		}
 
 		url := fmt.Sprintf("%s/%s/%s/%s/%s", reportHost, org, app, version, filename)
-		cm, err = updateConfigMap(cm, version, filename, url )
+		result.URL = url
+		report.URL = url
+		build, err := recordBuildReport(org, app, version, branch, buildNo, report, pa)
 		if err != nil {
-			renderError(w, "ERROR_UPDATING_CONFIG_MAP", http.StatusInternalServerError)
 			log.Println(err)
+		} else {
+			// the sinks are secondary copies of the local index, failing to reach them doesn't fail the upload
+			docs, stale, err := indexReport(build, report, fileBytes)
+			if err != nil {
+				indexErrorsTotal.add(1, "local")
+				log.Println(err)
+			} else {
+				indexDocumentsTotal.add(float64(len(docs)), "local", "success")
+				feedIndexSinks(docs, stale)
+			}
+			result.QualityGate, err = evaluateBuild(build, false)
+			if err != nil {
+				log.Println(err)
+			}
 		}
-		_, err = updatePipelineActivity(buildNo, branch, org, app, version, filename, url )
-		if err != nil {
-			renderError(w, "ERROR_UPDATING_PIPELINE_ACTIVITY", http.StatusInternalServerError)
-			log.Println(err)
+		// pipelines uploading many files can defer the ConfigMap and PipelineActivity updates to /finalize
+		if r.Header.Get("X-Defer-Update") != "true" {
+			cm, err := getOrCreateConfigMap(org, app)
+			if err != nil {
+				renderError(w, "ERROR_CREATING_CONFIG_MAP", http.StatusInternalServerError)
+				log.Println(err)
+			} else {
+				cm, err = updateConfigMap(cm, org, app, version)
+				if err != nil {
+					renderError(w, "ERROR_UPDATING_CONFIG_MAP", http.StatusInternalServerError)
+					log.Println(err)
+				}
+			}
+			_, err = updatePipelineActivity(buildNo, branch, org, app, version, filename, url, result)
+			if err != nil {
+				renderError(w, "ERROR_UPDATING_PIPELINE_ACTIVITY", http.StatusInternalServerError)
+				log.Println(err)
+			}
+			err = linkRelease(org, app, version)
+			if err != nil {
+				log.Println(err)
+			}
 		}
-		w.Write([]byte("SUCCESS"))
+		writeUploadResult(w, r, result)
 
 	})
 }
 
-func sendToElasticSearch(reader io.Reader, org string, appName string, version string, path string) error {
-	_, json, err := x2j.XmlReaderToJson(reader)
-	if err != nil {
-		return err
-	}
-	json, err = toJson(json, org, appName, version)
-	fmt.Printf("Successfully annnotated JUnit result with build info\n")
-	if err != nil {
-		return err
-	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(json))
-
-	req.Header.Set("Content-Type", "application/json")
-
-	if err != nil {
-		return err
-	}
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if (resp.StatusCode >= 200 && resp.StatusCode < 300 ) {
-		fmt.Printf("Sent %s to %s\n", path, url)
-	} else {
-		body, _ := ioutil.ReadAll(resp.Body)
-		return errors.New(fmt.Sprintf("HTTP status: %s; HTTP Body: %s\n", resp.Status, body))
-	}
-	return nil
-}
-
-func toJson(json []byte, org string, appName string, version string) ([]byte, error) {
-	m, err := mxj.NewMapJson(json)
-	if err != nil {
-		return nil, err
-	}
-
-	if err != nil {
-		return nil, err
-	}
-	// Kibana is quite restrictive in the way it accepts JSON, so just rebuild the JSON entirely!
-
-	utc, _ := time.LoadLocation("UTC")
-	data := map[string]interface{} {
-		"org": org,
-		"appName": appName,
-		"version": version,
-		"errors": m.ValueOrEmptyForPathString("testsuite.-errors"),
-		"failures": m.ValueOrEmptyForPathString("testsuite.-failures"),
-		"testsuiteName": m.ValueOrEmptyForPathString("testsuite.-name"),
-		"skippedTests": m.ValueOrEmptyForPathString("testsuite.-skipped"),
-		"tests": m.ValueOrEmptyForPathString("testsuite.-tests"),
-		"time": m.ValueOrEmptyForPathString("testsuite.-time"),
-		"timestamp": time.Now().In(utc).Format("2006-01-02T15:04:05Z"),
-		// TODO Add the TestCases
-	}
-	fmt.Printf("%s", data)
-	return json2.Marshal(data)
-}
-
 func renderError(w http.ResponseWriter, message string, statusCode int) {
-	w.WriteHeader(http.StatusBadRequest)
+	w.WriteHeader(statusCode)
 	w.Write([]byte(message))
 }
 
@@ -275,48 +397,87 @@ func createJenkinsClient() (versioned.Interface, error) {
 
 func getOrCreateConfigMap(org string, app string) (*corev1.ConfigMap, error) {
 	cmName := fmt.Sprintf("%s-%s-test-reports", org, app)
-	cm, err := kubernetesClient.CoreV1().ConfigMaps(cmNamespace).Get(cmName, metav1.GetOptions{})
-	if err != nil {
-		return nil, err
-	}
-	if cm == nil {
-		return kubernetesClient.CoreV1().ConfigMaps(cmNamespace).Create(&corev1.ConfigMap{
+	namespace := appNamespace(org, app)
+	cm, err := kubernetesClient.CoreV1().ConfigMaps(namespace).Get(cmName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm, err = kubernetesClient.CoreV1().ConfigMaps(namespace).Create(&corev1.ConfigMap{
 			ObjectMeta: metav1.ObjectMeta{
 				Name: cmName,
 			},
+			Data: map[string]string{},
 		})
-		if err != nil {
-			return nil, err
-		}
+		return cm, observeKubernetes("create_config_map", err)
+	}
+	if observeKubernetes("get_config_map", err) != nil {
+		return nil, err
 	}
 	return cm, nil
 }
 
-func updateConfigMap(cm *corev1.ConfigMap, version string, filename string, url string) (*corev1.ConfigMap, error){
-	if cm.Data[version] == "" {
-		cm.Data[version] = fmt.Sprintf("|-\n")
+func updateConfigMap(cm *corev1.ConfigMap, org string, app string, version string) (*corev1.ConfigMap, error){
+	m, err := loadAppManifest(org, app)
+	if err != nil {
+		return nil, err
 	}
-	cm.Data[version] = fmt.Sprintf("%s\n    %s: %s\n", cm.Data[version], filename, url)
-	return kubernetesClient.CoreV1().ConfigMaps(cmNamespace).Update(cm)
+	setConfigMapVersion(cm, m.Versions[version])
+	cm, err = kubernetesClient.CoreV1().ConfigMaps(cm.Namespace).Update(cm)
+	return cm, observeKubernetes("update_config_map", err)
+}
+
+// setConfigMapVersion lists the reports of a version from the app manifest, so the ConfigMap always matches what
+// the API serves
+func setConfigMapVersion(cm *corev1.ConfigMap, v *versionManifest) {
+	if cm.Data == nil {
+		cm.Data = map[string]string{}
+	}
+	if v == nil {
+		return
+	}
+	var names []string
+	for name := range v.Reports {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data := fmt.Sprintf("|-\n")
+	for _, name := range names {
+		data = fmt.Sprintf("%s\n    %s: %s\n", data, name, v.Reports[name])
+	}
+	cm.Data[v.Version] = data
 }
 
 func getReportHost() (string, error) {
-	svc, err := kubernetesClient.CoreV1().Services("jx-production").Get("jenkins-x-reports", metav1.GetOptions{})
-	if err != nil {
+	namespace := reportsNamespace
+	if namespace == "" {
+		namespace = "jx-production"
+	}
+	svc, err := kubernetesClient.CoreV1().Services(namespace).Get("jenkins-x-reports", metav1.GetOptions{})
+	if observeKubernetes("get_service", err) != nil {
 		return "", err
 	}
 	return svc.Annotations["fabric8.io/exposeUrl"], nil
 }
 
-func updatePipelineActivity(buildNo string, branch string, org string, app string, version string, filename string, url string) (*jenkinsxv1.PipelineActivity, error) {
-	pa, err :=jenkinsClient.JenkinsV1().PipelineActivities(cmNamespace).Get(fmt.Sprintf("%s-%s-%s-%s", org, app, branch, buildNo), metav1.GetOptions{})
+func getPipelineActivity(buildNo string, branch string, org string, app string) (*jenkinsxv1.PipelineActivity, error) {
+	pa, err := jenkinsClient.JenkinsV1().PipelineActivities(appNamespace(org, app)).Get(fmt.Sprintf("%s-%s-%s-%s", org, app, branch, buildNo), metav1.GetOptions{})
+	return pa, observeKubernetes("get_pipeline_activity", err)
+}
+
+func updatePipelineActivity(buildNo string, branch string, org string, app string, version string, filename string, url string, result *uploadResult) (*jenkinsxv1.PipelineActivity, error) {
+	return annotatePipelineActivity(buildNo, branch, org, app, func(annotations map[string]string) {
+		annotations[reportsAnnotation] = fmt.Sprintf("%s- %s: %s\n", annotations[reportsAnnotation], filename, url)
+		result.annotate(annotations)
+	})
+}
+
+func annotatePipelineActivity(buildNo string, branch string, org string, app string, annotate func(map[string]string)) (*jenkinsxv1.PipelineActivity, error) {
+	pa, err := getPipelineActivity(buildNo, branch, org, app)
 	if err != nil {
 		return nil, err
 	}
-	annotationName := "jenkins-x-reports"
 	if pa.Annotations == nil {
 		pa.Annotations = map[string]string {}
 	}
-	pa.Annotations[annotationName] = fmt.Sprintf("%s- %s: %s\n", pa.Annotations[annotationName], filename, url)
-	return jenkinsClient.JenkinsV1().PipelineActivities(cmNamespace).Update(pa)
+	annotate(pa.Annotations)
+	pa, err = jenkinsClient.JenkinsV1().PipelineActivities(pa.Namespace).Update(pa)
+	return pa, observeKubernetes("update_pipeline_activity", err)
 }
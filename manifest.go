@@ -0,0 +1,243 @@
+package main
+
+import (
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	neturl "net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var manifestLock sync.Mutex
+
+// activityLinks are the PipelineActivity details shown next to the reports of a build
+type activityLinks struct {
+	Name          string `json:"name"`
+	BuildURL      string `json:"buildUrl,omitempty"`
+	BuildLogsURL  string `json:"buildLogsUrl,omitempty"`
+	LastCommitSHA string `json:"lastCommitSHA,omitempty"`
+	LastCommitURL string `json:"lastCommitURL,omitempty"`
+}
+
+// appManifest lists every version and build of an app that reports have been uploaded for
+type appManifest struct {
+	Org      string                      `json:"org"`
+	App      string                      `json:"app"`
+	Versions map[string]*versionManifest `json:"versions"`
+	Updated  time.Time                   `json:"updated"`
+}
+
+// versionManifest lists the reports of a version, as they are listed in the ConfigMap, and the builds they came from
+type versionManifest struct {
+	Version string            `json:"version"`
+	Reports map[string]string `json:"reports"`
+	// Checksums are those of the report files as they were last uploaded, by file name
+	Checksums map[string]*reportChecksum `json:"checksums,omitempty"`
+	Builds    map[string]*buildManifest  `json:"builds"`
+	Updated   time.Time                  `json:"updated"`
+}
+
+// buildManifest is the outline of a build record
+type buildManifest struct {
+	Branch    string          `json:"branch"`
+	Build     string          `json:"build"`
+	Status    string          `json:"status,omitempty"`
+	Finalized bool            `json:"finalized"`
+	Tests     *testTotals     `json:"tests,omitempty"`
+	Coverage  *coverageResult `json:"coverage,omitempty"`
+	Reports   []string        `json:"reports"`
+	Activity  *activityLinks  `json:"activity,omitempty"`
+	Updated   time.Time       `json:"updated"`
+}
+
+func newActivityLinks(pa *jenkinsxv1.PipelineActivity) *activityLinks {
+	if pa == nil {
+		return nil
+	}
+	return &activityLinks{
+		Name:          pa.Name,
+		BuildURL:      pa.Spec.BuildURL,
+		BuildLogsURL:  pa.Spec.BuildLogsURL,
+		LastCommitSHA: pa.Spec.LastCommitSHA,
+		LastCommitURL: pa.Spec.LastCommitURL,
+	}
+}
+
+func manifestFile(org string, app string) string {
+	return filepath.Join(appDataPath(org, app), "manifests", org, storeKey(app)+".json")
+}
+
+// loadAppManifest returns the manifest of an app, which has no versions if nothing has been uploaded for it yet
+func loadAppManifest(org string, app string) (*appManifest, error) {
+	m := &appManifest{Org: org, App: app}
+	err := readJSON(manifestFile(org, app), m)
+	if err != nil {
+		return nil, err
+	}
+	if m.Versions == nil {
+		m.Versions = map[string]*versionManifest{}
+	}
+	return m, nil
+}
+
+// updateAppManifest refreshes the entry of a build in the manifest of its app
+func updateAppManifest(b *buildRecord) error {
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+
+	m, err := loadAppManifest(b.Org, b.App)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	v := m.Versions[b.Version]
+	if v == nil {
+		v = &versionManifest{Version: b.Version, Reports: map[string]string{}, Builds: map[string]*buildManifest{}}
+		m.Versions[b.Version] = v
+	}
+	entry := &buildManifest{
+		Branch:    b.Branch,
+		Build:     b.Build,
+		Status:    b.status(),
+		Finalized: b.Summary != nil,
+		Tests:     b.testTotals(),
+		Coverage:  b.coverage(),
+		Reports:   []string{},
+		Activity:  b.Activity,
+		Updated:   b.Updated,
+	}
+	for _, report := range b.sortedReports() {
+		v.Reports[report.Name] = report.URL
+		// builds of the same version share their report files, so an earlier build mustn't take back the checksum
+		if report.SHA256 != "" {
+			if v.Checksums == nil {
+				v.Checksums = map[string]*reportChecksum{}
+			}
+			if c := v.Checksums[report.Name]; c == nil || !c.Uploaded.After(report.Uploaded) {
+				v.Checksums[report.Name] = &reportChecksum{SHA256: report.SHA256, Uploaded: report.Uploaded}
+			}
+		}
+		entry.Reports = append(entry.Reports, report.Name)
+	}
+	v.Builds[buildKey(b.Branch, b.Build)] = entry
+	v.Updated = now
+	m.Updated = now
+	return writeJSON(manifestFile(b.Org, b.App), m)
+}
+
+// buildKey identifies a build within a version, the same way PipelineActivities are named
+func buildKey(branch string, buildNo string) string {
+	return branch + "-" + buildNo
+}
+
+// status is the quality gate verdict of the build, or whether any tests failed if it has no gates
+func (b *buildRecord) status() string {
+	if b.Verdict != nil && len(b.Verdict.Gates) > 0 {
+		return b.Verdict.Status
+	}
+	totals := b.testTotals()
+	if totals == nil {
+		return ""
+	}
+	return gateStatus(totals.Failures+totals.Errors == 0)
+}
+
+// listOrgs returns every org with a manifest, whichever team its apps belong to
+func listOrgs() ([]string, error) {
+	return listManifestEntries("manifests", true)
+}
+
+// listApps returns every app of an org with a manifest
+func listApps(org string) ([]string, error) {
+	return listManifestEntries(filepath.Join("manifests", org), false)
+}
+
+func listManifestEntries(dir string, dirs bool) ([]string, error) {
+	files, err := listTeamEntries(dataPath, dir)
+	if err != nil {
+		return nil, err
+	}
+	answer := []string{}
+	seen := map[string]bool{}
+	for _, f := range files {
+		if f.IsDir() != dirs || strings.HasPrefix(f.Name(), ".") || seen[f.Name()] {
+			continue
+		}
+		seen[f.Name()] = true
+		name := f.Name()
+		if !dirs {
+			if !strings.HasSuffix(name, ".json") {
+				continue
+			}
+			name, err = neturl.PathUnescape(strings.TrimSuffix(name, ".json"))
+			if err != nil {
+				continue
+			}
+		}
+		answer = append(answer, name)
+	}
+	sort.Strings(answer)
+	return answer, nil
+}
+
+// sortedVersions returns the versions of the manifest, most recently updated first
+func (m *appManifest) sortedVersions() []*versionManifest {
+	var versions []*versionManifest
+	for _, v := range m.Versions {
+		versions = append(versions, v)
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		if !versions[i].Updated.Equal(versions[j].Updated) {
+			return versions[i].Updated.After(versions[j].Updated)
+		}
+		return versions[i].Version > versions[j].Version
+	})
+	return versions
+}
+
+// versionsByBuilds returns the versions of the manifest by their most recently updated build, most recent first,
+// which is how retention ranks them. Versions without builds come last.
+func (m *appManifest) versionsByBuilds() []*versionManifest {
+	var versions []*versionManifest
+	latest := map[string]time.Time{}
+	for _, v := range m.Versions {
+		versions = append(versions, v)
+		if b := v.latestBuild(); b != nil {
+			latest[v.Version] = b.Updated
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		ti, tj := latest[versions[i].Version], latest[versions[j].Version]
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		return versions[i].Version > versions[j].Version
+	})
+	return versions
+}
+
+// sortedBuilds returns the builds of the version, most recently updated first
+func (v *versionManifest) sortedBuilds() []*buildManifest {
+	var builds []*buildManifest
+	for _, b := range v.Builds {
+		builds = append(builds, b)
+	}
+	sort.Slice(builds, func(i, j int) bool {
+		if !builds[i].Updated.Equal(builds[j].Updated) {
+			return builds[i].Updated.After(builds[j].Updated)
+		}
+		return buildKey(builds[i].Branch, builds[i].Build) > buildKey(builds[j].Branch, builds[j].Build)
+	})
+	return builds
+}
+
+// latestBuild returns the most recently updated build of the version
+func (v *versionManifest) latestBuild() *buildManifest {
+	builds := v.sortedBuilds()
+	if len(builds) == 0 {
+		return nil
+	}
+	return builds[0]
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVersionsByBuilds(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2026, 3, d, 0, 0, 0, 0, time.UTC)
+	}
+	version := func(name string, updated time.Time, builds ...time.Time) *versionManifest {
+		v := &versionManifest{Version: name, Updated: updated, Builds: map[string]*buildManifest{}}
+		for i, b := range builds {
+			build := &buildManifest{Branch: "master", Build: strconv.Itoa(i + 1), Updated: b}
+			v.Builds[buildKey(build.Branch, build.Build)] = build
+		}
+		return v
+	}
+	m := &appManifest{Versions: map[string]*versionManifest{
+		// 1.0.0 was updated last by an earlier run of retention, which mustn't make it the most recent version
+		"1.0.0": version("1.0.0", day(20), day(1), day(2)),
+		"1.1.0": version("1.1.0", day(10), day(10)),
+		"1.2.0": version("1.2.0", day(12), day(3), day(12)),
+		"1.3.0": version("1.3.0", day(12), day(12)),
+		"0.9.0": version("0.9.0", day(1)),
+	}}
+	var actual []string
+	for _, v := range m.versionsByBuilds() {
+		actual = append(actual, v.Version)
+	}
+	expected := []string{"1.3.0", "1.2.0", "1.1.0", "1.0.0", "0.9.0"}
+	if len(actual) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, actual)
+	}
+	for i := range expected {
+		if actual[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, actual)
+		}
+	}
+}
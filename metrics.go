@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// flagAppMetrics adds gauges for the latest build of every app and branch to /metrics
+var flagAppMetrics = os.Getenv("METRICS_APP_GAUGES") == "true"
+
+var (
+	uploadsTotal = newMetric("jenkins_x_reports_uploads_total", "counter",
+		"Uploaded reports by content type and outcome.", "content_type", "outcome")
+	uploadBytesTotal = newMetric("jenkins_x_reports_upload_bytes_total", "counter",
+		"Bytes received by uploads by content type and outcome.", "content_type", "outcome")
+	uploadDuration = newHistogram("jenkins_x_reports_upload_duration_seconds",
+		"Time taken to handle uploads by content type and outcome.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}, "content_type", "outcome")
+	indexDocumentsTotal = newMetric("jenkins_x_reports_index_documents_total", "counter",
+		"Documents sent to the index and its sinks by outcome.", "sink", "outcome")
+	indexErrorsTotal = newMetric("jenkins_x_reports_index_errors_total", "counter",
+		"Failures to index reports or send them to a sink.", "sink")
+	kubernetesErrorsTotal = newMetric("jenkins_x_reports_kubernetes_errors_total", "counter",
+		"Failed Kubernetes API calls by operation.", "operation")
+	deniedReadsTotal = newMetric("jenkins_x_reports_denied_reads_total", "counter",
+		"Reads of reports that were denied by org.", "org")
+	retentionRemovedBuildsTotal = newMetric("jenkins_x_reports_retention_removed_builds_total", "counter",
+		"Builds removed by the retention policy by org.", "org")
+	prunedBuildsTotal = newMetric("jenkins_x_reports_pruned_builds_total", "counter",
+		"Builds pruned after their PipelineActivity or preview Environment was deleted by trigger and policy.",
+		"trigger", "policy")
+	quotaRejectionsTotal = newMetric("jenkins_x_reports_quota_rejections_total", "counter",
+		"Uploads rejected for exceeding the quota of their org or app.", "org", "app")
+	checksumRejectionsTotal = newMetric("jenkins_x_reports_checksum_rejections_total", "counter",
+		"Uploads rejected for not matching the checksum sent along with them.", "org", "app")
+	promotionChecksTotal = newMetric("jenkins_x_reports_promotion_checks_total", "counter",
+		"Promotion checks by org and outcome.", "org", "outcome")
+)
+
+// metric is a counter, gauge or histogram with labels, kept in memory and written in the Prometheus text format
+type metric struct {
+	name    string
+	kind    string
+	help    string
+	labels  []string
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*metricValue
+}
+
+type metricValue struct {
+	labels []string
+	value  float64
+	counts []uint64
+	count  uint64
+}
+
+func newMetric(name string, kind string, help string, labels ...string) *metric {
+	return &metric{name: name, kind: kind, help: help, labels: labels, values: map[string]*metricValue{}}
+}
+
+func newHistogram(name string, help string, buckets []float64, labels ...string) *metric {
+	m := newMetric(name, "histogram", help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+func (m *metric) value(labels []string) *metricValue {
+	key := strings.Join(labels, "\x00")
+	v := m.values[key]
+	if v == nil {
+		v = &metricValue{labels: labels, counts: make([]uint64, len(m.buckets))}
+		m.values[key] = v
+	}
+	return v
+}
+
+func (m *metric) add(delta float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.value(labels).value += delta
+}
+
+func (m *metric) set(value float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.value(labels).value = value
+}
+
+func (m *metric) observe(value float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	v := m.value(labels)
+	v.value += value
+	v.count++
+	for i, bucket := range m.buckets {
+		if value <= bucket {
+			v.counts[i]++
+		}
+	}
+}
+
+func (m *metric) write(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	var keys []string
+	for key := range m.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		v := m.values[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %g\n", m.name, formatLabels(m.labels, v.labels), v.value)
+			continue
+		}
+		names := append(append([]string{}, m.labels...), "le")
+		for i, bucket := range m.buckets {
+			values := append(append([]string{}, v.labels...), fmt.Sprintf("%g", bucket))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), v.counts[i])
+		}
+		values := append(append([]string{}, v.labels...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, formatLabels(names, values), v.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", m.name, formatLabels(m.labels, v.labels), v.value)
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, formatLabels(m.labels, v.labels), v.count)
+	}
+}
+
+func formatLabels(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var pairs []string
+	for i, name := range names {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, name, escape.Replace(values[i])))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// observeKubernetes counts a failed Kubernetes API call, resources that don't exist are expected and not counted
+func observeKubernetes(operation string, err error) error {
+	if err != nil && !apierrors.IsNotFound(err) {
+		kubernetesErrorsTotal.add(1, operation)
+	}
+	return err
+}
+
+// uploadRecorder captures the status the upload handler responded with
+type uploadRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *uploadRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *uploadRecorder) Write(data []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(data)
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+// instrumentUploads counts the uploads handled by h, the bytes they sent and the time they took
+func instrumentUploads(h http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &uploadRecorder{ResponseWriter: w}
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		h(rec, r)
+		contentType := r.Header.Get("X-Content-Type")
+		if contentType == "" {
+			contentType = "unknown"
+		}
+		outcome := "success"
+		if rec.status >= 500 {
+			outcome = "server_error"
+		} else if rec.status >= 400 {
+			outcome = "client_error"
+		}
+		uploadsTotal.add(1, contentType, outcome)
+		uploadBytesTotal.add(float64(body.count), contentType, outcome)
+		uploadDuration.observe(time.Since(start).Seconds(), contentType, outcome)
+	})
+}
+
+// metricsHandler serves the metrics of the service in the Prometheus text format
+func metricsHandler() http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var out bytes.Buffer
+		for _, m := range []*metric{uploadsTotal, uploadBytesTotal, uploadDuration, indexDocumentsTotal,
+			indexErrorsTotal, kubernetesErrorsTotal, deniedReadsTotal, retentionRemovedBuildsTotal, prunedBuildsTotal,
+			quotaRejectionsTotal, checksumRejectionsTotal, promotionChecksTotal} {
+			m.write(&out)
+		}
+		queueDepth := newMetric("jenkins_x_reports_sink_queue_depth", "gauge",
+			"Reports waiting to be sent to a sink.", "sink")
+		for _, worker := range sinkWorkers {
+			queueDepth.set(float64(len(worker.queue)), worker.sink.Name())
+		}
+		queueDepth.write(&out)
+		err := writeStorageMetrics(&out)
+		if err != nil {
+			renderError(w, "CANT_READ_USAGE", http.StatusInternalServerError)
+			log.Println(err)
+			return
+		}
+		if flagAppMetrics {
+			err := writeAppMetrics(&out)
+			if err != nil {
+				renderError(w, "CANT_READ_MANIFEST", http.StatusInternalServerError)
+				log.Println(err)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(out.Bytes())
+	})
+}
+
+// writeStorageMetrics writes gauges for the storage used by every app with report files and for their quotas,
+// leaving the quotas out if they can't be read
+func writeStorageMetrics(w io.Writer) error {
+	labels := []string{"org", "app"}
+	bytesUsed := newMetric("jenkins_x_reports_storage_bytes", "gauge",
+		"Bytes taken up by the report files of an app.", labels...)
+	filesUsed := newMetric("jenkins_x_reports_storage_files", "gauge",
+		"Report files stored for an app.", labels...)
+	bytesQuota := newMetric("jenkins_x_reports_storage_quota_bytes", "gauge",
+		"Quota for the bytes of the report files of an org or app, the app is empty for orgs.", labels...)
+	filesQuota := newMetric("jenkins_x_reports_storage_quota_files", "gauge",
+		"Quota for the report files of an org or app, the app is empty for orgs.", labels...)
+	config, err := loadQuotas()
+	if err != nil {
+		log.Println(err)
+		config = nil
+	}
+	orgs, err := listTeamEntries(uploadPath, "")
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, f := range orgs {
+		org := f.Name()
+		if !f.IsDir() || strings.HasPrefix(org, ".") || seen[org] {
+			continue
+		}
+		seen[org] = true
+		apps, err := reportApps(org)
+		if err != nil {
+			return err
+		}
+		if config != nil {
+			setQuotaGauges(bytesQuota, filesQuota, config.orgLimits(org), org, "")
+		}
+		for _, app := range apps {
+			usage, err := appStorageUsage(org, app)
+			if err != nil {
+				return err
+			}
+			bytesUsed.set(float64(usage.Bytes), org, app)
+			filesUsed.set(float64(usage.Files), org, app)
+			if config != nil {
+				setQuotaGauges(bytesQuota, filesQuota, config.appLimits(org, app), org, app)
+			}
+		}
+	}
+	for _, m := range []*metric{bytesUsed, filesUsed, bytesQuota, filesQuota} {
+		m.write(w)
+	}
+	return nil
+}
+
+func setQuotaGauges(bytesQuota *metric, filesQuota *metric, limits quotaLimits, org string, app string) {
+	if limits.Bytes > 0 {
+		bytesQuota.set(float64(limits.Bytes), org, app)
+	}
+	if limits.Files > 0 {
+		filesQuota.set(float64(limits.Files), org, app)
+	}
+}
+
+// writeAppMetrics writes gauges for the latest build of every branch of every app
+func writeAppMetrics(w io.Writer) error {
+	labels := []string{"org", "app", "branch"}
+	tests := newMetric("jenkins_x_reports_latest_build_tests", "gauge",
+		"Tests of the latest build of a branch.", labels...)
+	failures := newMetric("jenkins_x_reports_latest_build_failures", "gauge",
+		"Failed tests, including errors, of the latest build of a branch.", labels...)
+	skipped := newMetric("jenkins_x_reports_latest_build_skipped", "gauge",
+		"Skipped tests of the latest build of a branch.", labels...)
+	coverage := newMetric("jenkins_x_reports_latest_build_coverage_percent", "gauge",
+		"Line coverage of the latest build of a branch.", labels...)
+	orgs, err := listOrgs()
+	if err != nil {
+		return err
+	}
+	for _, org := range orgs {
+		apps, err := listApps(org)
+		if err != nil {
+			return err
+		}
+		for _, app := range apps {
+			m, err := loadAppManifest(org, app)
+			if err != nil {
+				return err
+			}
+			latest := map[string]*buildManifest{}
+			for _, v := range m.Versions {
+				for _, b := range v.Builds {
+					if latest[b.Branch] == nil || b.Updated.After(latest[b.Branch].Updated) {
+						latest[b.Branch] = b
+					}
+				}
+			}
+			for branch, b := range latest {
+				if b.Tests != nil {
+					tests.set(float64(b.Tests.Tests), org, app, branch)
+					failures.set(float64(b.Tests.Failures+b.Tests.Errors), org, app, branch)
+					skipped.set(float64(b.Tests.Skipped), org, app, branch)
+				}
+				if b.Coverage != nil {
+					coverage.set(b.Coverage.Percent, org, app, branch)
+				}
+			}
+		}
+	}
+	for _, m := range []*metric{tests, failures, skipped, coverage} {
+		m.write(w)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	"html/template"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+)
+
+var portalTemplates = template.Must(template.New("portal").Funcs(template.FuncMap{
+	"timestamp": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.UTC().Format("2006-01-02 15:04 UTC")
+	},
+	"coverage": func(c *coverageResult) string {
+		if c == nil {
+			return ""
+		}
+		return fmt.Sprintf("%.1f%%", c.Percent)
+	},
+	"shortSHA": func(sha string) string {
+		if len(sha) > 7 {
+			return sha[:7]
+		}
+		return sha
+	},
+}).Parse(portalTemplateText))
+
+// portalPage is the model the portal templates are rendered with, only the fields of the page's level are set
+type portalPage struct {
+	Title    string
+	Crumbs   []portalCrumb
+	Orgs     []portalOrg
+	Apps     []portalApp
+	Versions []portalVersion
+	Builds   []*buildManifest
+	Reports  []reportLink
+	Release  *jenkinsxv1.Release
+	// Environments are only listed when the Environments and PipelineActivities of the team can be read
+	Environments []*environmentView
+}
+
+type portalCrumb struct {
+	Name string
+	Path string
+}
+
+type portalOrg struct {
+	Name string
+	Apps int
+}
+
+type portalApp struct {
+	Name          string
+	LatestVersion string
+	Latest        *buildManifest
+	Updated       time.Time
+}
+
+type portalVersion struct {
+	Version string
+	Builds  int
+	Latest  *buildManifest
+	Updated time.Time
+}
+
+// renderPortal renders the org, app and version pages for the directories of the report tree, returning false for
+// anything deeper so the file server handles it
+func renderPortal(w http.ResponseWriter, r *http.Request) bool {
+	parts := splitPath(r.URL.Path)
+	if len(parts) > 3 {
+		return false
+	}
+	for _, p := range parts {
+		if !validName(p) {
+			return false
+		}
+	}
+	page := &portalPage{Title: "Reports", Crumbs: []portalCrumb{{Name: "orgs", Path: "/"}}}
+	for i, p := range parts {
+		page.Crumbs = append(page.Crumbs, portalCrumb{Name: p, Path: "/" + path.Join(parts[:i+1]...) + "/"})
+		page.Title = p
+	}
+	var err error
+	var name string
+	switch len(parts) {
+	case 0:
+		name = "orgs"
+		page.Orgs, err = portalOrgs(requestReader(r))
+	case 1:
+		name = "apps"
+		page.Apps, err = portalApps(requestReader(r), parts[0])
+	case 2:
+		name = "versions"
+		page.Versions, err = portalVersions(parts[0], parts[1])
+		page.Environments = portalEnvironments(parts[0], parts[1])
+	case 3:
+		name = "version"
+		err = page.addVersion(parts[0], parts[1], parts[2])
+	}
+	if err != nil {
+		renderError(w, "CANT_READ_MANIFEST", http.StatusInternalServerError)
+		log.Println(err)
+		return true
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Vary", "Accept")
+	err = portalTemplates.ExecuteTemplate(w, name, page)
+	if err != nil {
+		log.Println(err)
+	}
+	return true
+}
+
+func portalOrgs(rd *reader) ([]portalOrg, error) {
+	orgs, err := listOrgs()
+	if err != nil {
+		return nil, err
+	}
+	var answer []portalOrg
+	for _, org := range rd.visibleOrgs(orgs) {
+		apps, err := listApps(org)
+		if err != nil {
+			return nil, err
+		}
+		answer = append(answer, portalOrg{Name: org, Apps: len(rd.visibleApps(org, apps))})
+	}
+	return answer, nil
+}
+
+func portalApps(rd *reader, org string) ([]portalApp, error) {
+	apps, err := listApps(org)
+	if err != nil {
+		return nil, err
+	}
+	var answer []portalApp
+	for _, app := range rd.visibleApps(org, apps) {
+		m, err := loadAppManifest(org, app)
+		if err != nil {
+			return nil, err
+		}
+		entry := portalApp{Name: app, Updated: m.Updated}
+		if versions := m.sortedVersions(); len(versions) > 0 {
+			entry.LatestVersion = versions[0].Version
+			entry.Latest = versions[0].latestBuild()
+		}
+		answer = append(answer, entry)
+	}
+	return answer, nil
+}
+
+func portalVersions(org string, app string) ([]portalVersion, error) {
+	m, err := loadAppManifest(org, app)
+	if err != nil {
+		return nil, err
+	}
+	var answer []portalVersion
+	for _, v := range m.sortedVersions() {
+		answer = append(answer, portalVersion{
+			Version: v.Version,
+			Builds:  len(v.Builds),
+			Latest:  v.latestBuild(),
+			Updated: v.Updated,
+		})
+	}
+	return answer, nil
+}
+
+func portalEnvironments(org string, app string) []*environmentView {
+	if jenkinsClient == nil {
+		return nil
+	}
+	views, err := appEnvironments(org, app)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return views
+}
+
+func (page *portalPage) addVersion(org string, app string, version string) error {
+	m, err := loadAppManifest(org, app)
+	if err != nil {
+		return err
+	}
+	v := m.Versions[version]
+	if v == nil {
+		return nil
+	}
+	page.Builds = v.sortedBuilds()
+	for name, url := range v.Reports {
+		page.Reports = append(page.Reports, reportLink{Name: name, URL: url})
+	}
+	sort.Slice(page.Reports, func(i, j int) bool {
+		return page.Reports[i].Name < page.Reports[j].Name
+	})
+	page.Release = versionRelease(org, app, version)
+	return nil
+}
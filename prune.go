@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/tools/cache"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// archiveDir holds what has been archived rather than deleted within each storage root
+const archiveDir = ".archive"
+
+// the policies for the reports of deleted PipelineActivities and preview Environments, set by PRUNE_ON_DELETE
+const (
+	pruneArchive = "archive"
+	pruneDelete  = "delete"
+)
+
+// pruneOnDelete is what happens to the reports of a build once Jenkins X deletes its PipelineActivity, or to the
+// reports of a pull request once its preview Environment is deleted. Anything else than archive or delete keeps them.
+var pruneOnDelete = os.Getenv("PRUNE_ON_DELETE")
+
+// namespacesInterval is how often new team namespaces are looked for to inform about
+const namespacesInterval = 30 * time.Second
+
+// startPruning informs about the PipelineActivities and Environments of every team namespace being deleted, as long
+// as there is a policy for them
+func startPruning() {
+	if pruneOnDelete != pruneArchive && pruneOnDelete != pruneDelete {
+		return
+	}
+	log.Printf("Pruning the reports of deleted PipelineActivities and preview Environments (%s)\n", pruneOnDelete)
+	go func() {
+		informed := map[string]bool{}
+		for {
+			for _, namespace := range teamNamespaces() {
+				if informed[namespace] {
+					continue
+				}
+				informed[namespace] = true
+				namespace := namespace
+				activities := jenkinsClient.JenkinsV1().PipelineActivities(namespace)
+				startInformer("pipeline_activities", &jenkinsxv1.PipelineActivity{}, &cache.ListWatch{
+					ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+						return activities.List(opts)
+					},
+					WatchFunc: activities.Watch,
+				}, cache.ResourceEventHandlerFuncs{DeleteFunc: func(obj interface{}) {
+					if pa, ok := deletedObject(obj).(*jenkinsxv1.PipelineActivity); ok {
+						pruneDeletedActivity(namespace, pa)
+					}
+				}})
+				environments := jenkinsClient.JenkinsV1().Environments(namespace)
+				startInformer("environments", &jenkinsxv1.Environment{}, &cache.ListWatch{
+					ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+						return environments.List(opts)
+					},
+					WatchFunc: environments.Watch,
+				}, cache.ResourceEventHandlerFuncs{DeleteFunc: func(obj interface{}) {
+					if env, ok := deletedObject(obj).(*jenkinsxv1.Environment); ok {
+						pruneDeletedPreview(namespace, env)
+					}
+				}})
+			}
+			time.Sleep(namespacesInterval)
+		}
+	}()
+}
+
+// startInformer runs a shared informer for the objects of a resource, which lists them again and resumes watching
+// by itself whenever the watch ends or fails, and hands what changes to handler. Objects deleted while it wasn't
+// watching are handed to it once it has listed again.
+func startInformer(resource string, objType runtime.Object, lw *cache.ListWatch, handler cache.ResourceEventHandler) {
+	informer := cache.NewSharedIndexInformer(&cache.ListWatch{
+		ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+			obj, err := lw.ListFunc(opts)
+			return obj, observeKubernetes("list_"+resource, err)
+		},
+		WatchFunc: func(opts metav1.ListOptions) (watch.Interface, error) {
+			w, err := lw.WatchFunc(opts)
+			return w, observeKubernetes("watch_"+resource, err)
+		},
+	}, objType, 0, cache.Indexers{})
+	informer.AddEventHandler(handler)
+	go informer.Run(wait.NeverStop)
+}
+
+// deletedObject returns the last known state of an object an informer hands over as deleted, which may be all it
+// has if the deletion happened while it wasn't watching
+func deletedObject(obj interface{}) interface{} {
+	if unknown, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		return unknown.Obj
+	}
+	return obj
+}
+
+// pruneDeletedActivity prunes the build of a deleted PipelineActivity, whose pipeline is named org/app/branch
+func pruneDeletedActivity(namespace string, pa *jenkinsxv1.PipelineActivity) {
+	parts := strings.SplitN(pa.Spec.Pipeline, "/", 3)
+	if len(parts) != 3 || pa.Spec.Build == "" {
+		return
+	}
+	org, app, branch := parts[0], parts[1], parts[2]
+	pruneDeleted(namespace, org, app, "pipeline_activity", func(rank int, v *versionManifest, b *buildManifest) string {
+		if b.Branch == branch && b.Build == pa.Spec.Build {
+			return fmt.Sprintf("PipelineActivity %s was deleted", pa.Name)
+		}
+		return ""
+	})
+}
+
+// pruneDeletedPreview prunes every build of the pull request of a deleted preview Environment
+func pruneDeletedPreview(namespace string, env *jenkinsxv1.Environment) {
+	if env.Spec.Kind != jenkinsxv1.EnvironmentKindTypePreview || env.Spec.PreviewGitSpec.Name == "" {
+		return
+	}
+	org, app := gitOwnerAndRepository(env.Spec.Source.URL)
+	if env.Spec.PreviewGitSpec.ApplicationName != "" {
+		app = env.Spec.PreviewGitSpec.ApplicationName
+	}
+	if org == "" || app == "" {
+		return
+	}
+	branch := "PR-" + strings.TrimPrefix(env.Spec.PreviewGitSpec.Name, "PR-")
+	pruneDeleted(namespace, org, app, "preview", func(rank int, v *versionManifest, b *buildManifest) string {
+		if b.Branch == branch {
+			return fmt.Sprintf("preview Environment %s was deleted", env.Name)
+		}
+		return ""
+	})
+}
+
+// pruneDeleted prunes builds of an app after a deletion in the namespace of the team it belongs to, a team can't
+// prune the reports of another. Builds of a version that was released are kept like retention keeps them.
+func pruneDeleted(namespace string, org string, app string, trigger string, expire buildExpiry) {
+	if appNamespace(org, app) != namespace {
+		return
+	}
+	// the builds of released versions are kept, so nothing is pruned without the Releases
+	list, err := jenkinsClient.JenkinsV1().Releases(namespace).List(metav1.ListOptions{})
+	if observeKubernetes("list_releases", err) != nil {
+		log.Printf("Failed to list the Releases of %s, not pruning %s/%s: %s\n", namespace, org, app, err)
+		return
+	}
+	removed, err := pruneAppBuilds(org, app, keepReleased(list.Items, org, app, expire), false,
+		pruneOnDelete == pruneArchive)
+	prunedBuildsTotal.add(float64(len(removed)), trigger, pruneOnDelete)
+	for _, rb := range removed {
+		log.Printf("Pruned build %s of %s/%s %s (%s): %s\n", buildKey(rb.Branch, rb.Build), org, app, rb.Version,
+			pruneOnDelete, rb.Reason)
+	}
+	if err != nil {
+		log.Printf("Failed to prune %s/%s: %s\n", org, app, err)
+	}
+}
+
+// gitOwnerAndRepository returns the owner and repository of a git URL such as https://github.com/org/app.git or
+// git@github.com:org/app.git
+func gitOwnerAndRepository(url string) (string, string) {
+	parts := strings.Split(strings.TrimSuffix(strings.Replace(url, ":", "/", -1), ".git"), "/")
+	if len(parts) < 2 {
+		return "", ""
+	}
+	return parts[len(parts)-2], parts[len(parts)-1]
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/cache"
+	"testing"
+)
+
+func TestKeepReleased(t *testing.T) {
+	releases := []jenkinsxv1.Release{
+		{Spec: jenkinsxv1.ReleaseSpec{GitOwner: "myorg", GitRepository: "web", Version: "v1.0.0"}},
+		{Spec: jenkinsxv1.ReleaseSpec{Name: "api", Version: "2.0.0"}},
+	}
+	expire := keepReleased(releases, "myorg", "web", func(rank int, v *versionManifest, b *buildManifest) string {
+		return "PipelineActivity web-1 was deleted"
+	})
+	for version, expired := range map[string]bool{
+		"1.0.0":  false,
+		"v1.0.0": false,
+		"1.0.1":  true,
+		"2.0.0":  true,
+	} {
+		reason := expire(0, &versionManifest{Version: version}, &buildManifest{Branch: "master", Build: "1"})
+		if (reason != "") != expired {
+			t.Errorf("expected the build of %s to expire to be %v, got %q", version, expired, reason)
+		}
+	}
+}
+
+func TestDeletedObject(t *testing.T) {
+	pa := &jenkinsxv1.PipelineActivity{ObjectMeta: metav1.ObjectMeta{Name: "myorg-web-master-1"}}
+	for _, obj := range []interface{}{pa, cache.DeletedFinalStateUnknown{Key: "jx/myorg-web-master-1", Obj: pa}} {
+		if deleted, ok := deletedObject(obj).(*jenkinsxv1.PipelineActivity); !ok || deleted != pa {
+			t.Errorf("expected the PipelineActivity to be handed over for %T, got %v", obj, deleted)
+		}
+	}
+}
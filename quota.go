@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ghodss/yaml"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const quotasConfigMap = "jenkins-x-reports-quotas"
+const quotasKey = "quotas.yaml"
+
+// defaultSoftLimit is the percentage of a quota from which uploads are warned about it
+const defaultSoftLimit = 80
+
+// quotaConfig is read from the quotas.yaml key of the jenkins-x-reports-quotas ConfigMap, e.g.
+//
+//	softLimit: 80
+//	orgs:
+//	  "*": {bytes: 10737418240, files: 100000}
+//	apps:
+//	  "*": {bytes: 1073741824, files: 10000}
+//	  myorg/big-app: {bytes: 5368709120}
+//
+// "*" is the quota of every org or app without one of its own, limits that aren't set or are 0 are unlimited.
+// softLimit is the percentage of a limit from which uploads get warnings.
+type quotaConfig struct {
+	SoftLimit float64                `json:"softLimit"`
+	Orgs      map[string]quotaLimits `json:"orgs"`
+	Apps      map[string]quotaLimits `json:"apps"`
+	loaded    time.Time
+}
+
+// quotaLimits caps the bytes and number of report files stored for an org or app
+type quotaLimits struct {
+	Bytes int64 `json:"bytes,omitempty"`
+	Files int64 `json:"files,omitempty"`
+}
+
+// storageUsage is what the report files of an org or app take up
+type storageUsage struct {
+	Bytes int64 `json:"bytes"`
+	Files int64 `json:"files"`
+}
+
+// quotaStatus is the usage and quota of an org or app, as served by the API
+type quotaStatus struct {
+	Org       string       `json:"org"`
+	App       string       `json:"app,omitempty"`
+	Usage     storageUsage `json:"usage"`
+	Limits    quotaLimits  `json:"limits"`
+	SoftLimit float64      `json:"softLimit"`
+}
+
+// errQuotaExceeded is returned when an upload would take an org or app over its quota
+type errQuotaExceeded struct {
+	scope    string
+	name     string
+	resource string
+	limit    int64
+}
+
+func (e *errQuotaExceeded) Error() string {
+	return fmt.Sprintf("%s %s would exceed its quota of %d %s", e.scope, e.name, e.limit, e.resource)
+}
+
+// code is the error rendered to the uploader, e.g. APP_QUOTA_EXCEEDED
+func (e *errQuotaExceeded) code() string {
+	return strings.ToUpper(e.scope) + "_QUOTA_EXCEEDED"
+}
+
+var quotaLock sync.Mutex
+var cachedQuotas *quotaConfig
+
+// appUsage caches the usage of every app that has been looked at, it is kept up to date by uploads and forgotten
+// whenever report files are removed
+var appUsage = map[string]*storageUsage{}
+
+func loadQuotas() (*quotaConfig, error) {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	if cachedQuotas != nil && time.Since(cachedQuotas.loaded) < authCacheTTL {
+		return cachedQuotas, nil
+	}
+	config := &quotaConfig{}
+	cm, err := kubernetesClient.CoreV1().ConfigMaps(cmNamespace).Get(quotasConfigMap, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, observeKubernetes("get_config_map", err)
+	}
+	if err == nil {
+		err = yaml.Unmarshal([]byte(cm.Data[quotasKey]), config)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid %s in ConfigMap %s: %s", quotasKey, quotasConfigMap, err))
+		}
+	}
+	if config.SoftLimit <= 0 {
+		config.SoftLimit = defaultSoftLimit
+	}
+	config.loaded = time.Now()
+	cachedQuotas = config
+	return config, nil
+}
+
+func (config *quotaConfig) orgLimits(org string) quotaLimits {
+	if limits, ok := config.Orgs[org]; ok {
+		return limits
+	}
+	return config.Orgs["*"]
+}
+
+func (config *quotaConfig) appLimits(org string, app string) quotaLimits {
+	if limits, ok := config.Apps[org+"/"+app]; ok {
+		return limits
+	}
+	return config.Apps["*"]
+}
+
+// reserveQuota accounts for a report file about to be written, which may replace an earlier one, unless it would
+// take its app or org over their quota. It returns a warning for every limit the upload gets close to.
+func reserveQuota(org string, app string, path string, size int64) ([]string, error) {
+	config, err := loadQuotas()
+	if err != nil {
+		return nil, err
+	}
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	delta := storageUsage{Bytes: size, Files: 1}
+	if info, err := statStoredFile(path); err == nil {
+		delta = storageUsage{Bytes: size - info.Size()}
+	}
+	appUsed, err := cachedAppUsage(org, app)
+	if err != nil {
+		return nil, err
+	}
+	orgUsed, err := cachedOrgUsage(org, app)
+	if err != nil {
+		return nil, err
+	}
+	var warnings []string
+	for _, q := range []struct {
+		scope  string
+		name   string
+		used   storageUsage
+		limits quotaLimits
+	}{
+		{"app", org + "/" + app, *appUsed, config.appLimits(org, app)},
+		{"org", org, orgUsed, config.orgLimits(org)},
+	} {
+		for _, resource := range []struct {
+			name  string
+			used  int64
+			delta int64
+			limit int64
+		}{
+			{"bytes", q.used.Bytes, delta.Bytes, q.limits.Bytes},
+			{"files", q.used.Files, delta.Files, q.limits.Files},
+		} {
+			if resource.limit <= 0 {
+				continue
+			}
+			used := resource.used + resource.delta
+			if resource.delta > 0 && used > resource.limit {
+				return nil, &errQuotaExceeded{scope: q.scope, name: q.name, resource: resource.name, limit: resource.limit}
+			}
+			if percent := 100 * float64(used) / float64(resource.limit); percent >= config.SoftLimit {
+				warnings = append(warnings, fmt.Sprintf("%s %s uses %.0f%% of its quota of %d %s", q.scope, q.name,
+					percent, resource.limit, resource.name))
+			}
+		}
+	}
+	appUsed.Bytes += delta.Bytes
+	appUsed.Files += delta.Files
+	return warnings, nil
+}
+
+// forgetUsage drops the cached usage of an app, which is worked out again the next time it is needed
+func forgetUsage(org string, app string) {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	delete(appUsage, org+"/"+app)
+}
+
+// appStorageUsage returns what the report files of an app take up
+func appStorageUsage(org string, app string) (storageUsage, error) {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	usage, err := cachedAppUsage(org, app)
+	if err != nil {
+		return storageUsage{}, err
+	}
+	return *usage, nil
+}
+
+// orgStorageUsage returns what the report files of every app of an org take up
+func orgStorageUsage(org string) (storageUsage, error) {
+	quotaLock.Lock()
+	defer quotaLock.Unlock()
+	return cachedOrgUsage(org, "")
+}
+
+func cachedAppUsage(org string, app string) (*storageUsage, error) {
+	if usage, ok := appUsage[org+"/"+app]; ok {
+		return usage, nil
+	}
+	usage := &storageUsage{}
+	err := filepath.Walk(filepath.Join(appUploadPath(org, app), org, app), func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") {
+			usage.Bytes += info.Size()
+			usage.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	appUsage[org+"/"+app] = usage
+	return usage, nil
+}
+
+// cachedOrgUsage adds up the usage of every app with report files in the org, and of app which may not have any yet
+func cachedOrgUsage(org string, app string) (storageUsage, error) {
+	apps, err := reportApps(org)
+	if err != nil {
+		return storageUsage{}, err
+	}
+	if app != "" {
+		apps = append(apps, app)
+	}
+	total := storageUsage{}
+	seen := map[string]bool{}
+	for _, a := range apps {
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+		usage, err := cachedAppUsage(org, a)
+		if err != nil {
+			return storageUsage{}, err
+		}
+		total.Bytes += usage.Bytes
+		total.Files += usage.Files
+	}
+	return total, nil
+}
+
+// reportApps lists the apps of an org that have report files, whichever team they belong to
+func reportApps(org string) ([]string, error) {
+	files, err := listTeamEntries(uploadPath, org)
+	if err != nil {
+		return nil, err
+	}
+	var apps []string
+	for _, f := range files {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
+			apps = append(apps, f.Name())
+		}
+	}
+	return apps, nil
+}
+
+// isStorageFull tells whether a write failed because the volume is full
+func isStorageFull(err error) bool {
+	switch e := err.(type) {
+	case *os.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+	return err == syscall.ENOSPC
+}
+
+// quotaHandler serves the usage and quota of an org, or of one of its apps if app isn't empty
+func quotaHandler(w http.ResponseWriter, r *http.Request, org string, app string) {
+	config, err := loadQuotas()
+	if err != nil {
+		renderJSONError(w, "CANT_READ_QUOTAS", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	status := &quotaStatus{Org: org, App: app, SoftLimit: config.SoftLimit}
+	if app == "" {
+		status.Limits = config.orgLimits(org)
+		status.Usage, err = orgStorageUsage(org)
+	} else {
+		status.Limits = config.appLimits(org, app)
+		status.Usage, err = appStorageUsage(org, app)
+	}
+	if err != nil {
+		renderJSONError(w, "CANT_READ_USAGE", http.StatusInternalServerError)
+		log.Println(err)
+		return
+	}
+	renderAPI(w, r, status)
+}
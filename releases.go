@@ -0,0 +1,167 @@
+package main
+
+import (
+	json2 "encoding/json"
+	"fmt"
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/cache"
+	"log"
+	"time"
+)
+
+// versionSummary is what the reports found about a version, as of its latest build, recorded on the Release made
+// of it
+type versionSummary struct {
+	Org      string          `json:"org"`
+	App      string          `json:"app"`
+	Version  string          `json:"version"`
+	Status   string          `json:"status"`
+	Builds   int             `json:"builds"`
+	Latest   string          `json:"latest"`
+	Tests    *testTotals     `json:"tests,omitempty"`
+	Coverage *coverageResult `json:"coverage,omitempty"`
+	Verdict  *gateVerdict    `json:"verdict,omitempty"`
+	URL      string          `json:"url,omitempty"`
+}
+
+// summarizeVersion summarizes a version from the manifest and the record of its latest build
+func summarizeVersion(org string, app string, v *versionManifest) (*versionSummary, error) {
+	summary := &versionSummary{Org: org, App: app, Version: v.Version, Builds: len(v.Builds)}
+	latest := v.latestBuild()
+	if latest == nil {
+		return summary, nil
+	}
+	b, err := loadBuildRecord(org, app, latest.Branch, latest.Build)
+	if err != nil {
+		return nil, err
+	}
+	summary.Status = latest.Status
+	summary.Latest = buildKey(latest.Branch, latest.Build)
+	summary.Tests = latest.Tests
+	summary.Coverage = latest.Coverage
+	summary.Verdict = b.Verdict
+	return summary, nil
+}
+
+// linkRelease records the summary of a version on the Release made of it, if Jenkins X has created one yet
+func linkRelease(org string, app string, version string) error {
+	list, err := jenkinsClient.JenkinsV1().Releases(appNamespace(org, app)).List(metav1.ListOptions{})
+	if err = observeKubernetes("list_releases", err); err != nil {
+		return err
+	}
+	release := findRelease(list.Items, org, app, version)
+	if release == nil {
+		return nil
+	}
+	return annotateRelease(release, org, app, version)
+}
+
+// annotateRelease records the summary of the version of an app on its Release, leaving the Release alone if the
+// summary hasn't changed
+func annotateRelease(release *jenkinsxv1.Release, org string, app string, version string) error {
+	m, err := loadAppManifest(org, app)
+	if err != nil {
+		return err
+	}
+	v := m.Versions[version]
+	if v == nil {
+		return nil
+	}
+	summary, err := summarizeVersion(org, app, v)
+	if err != nil {
+		return err
+	}
+	reportHost, err := getReportHost()
+	if err != nil {
+		log.Println(err)
+	} else {
+		summary.URL = fmt.Sprintf("%s/%s/%s/%s/", reportHost, org, app, version)
+	}
+	data, _ := json2.Marshal(summary)
+	if release.Annotations[summaryAnnotation] == string(data) {
+		return nil
+	}
+	if release.Annotations == nil {
+		release.Annotations = map[string]string{}
+	}
+	release.Annotations[summaryAnnotation] = string(data)
+	if summary.URL != "" {
+		release.Annotations[reportsAnnotation] = summary.URL
+	}
+	if summary.Verdict != nil {
+		verdict, _ := json2.Marshal(summary.Verdict)
+		release.Annotations[qualityGateAnnotation] = string(verdict)
+	}
+	_, err = jenkinsClient.JenkinsV1().Releases(release.Namespace).Update(release)
+	return observeKubernetes("update_release", err)
+}
+
+// startReleaseLinking informs about the Releases of every team namespace, so a Release created after its version was
+// tested gets the summary of its reports too. The Releases already there when it starts are linked as well.
+func startReleaseLinking() {
+	go func() {
+		informed := map[string]bool{}
+		for {
+			for _, namespace := range teamNamespaces() {
+				if informed[namespace] {
+					continue
+				}
+				informed[namespace] = true
+				namespace := namespace
+				releases := jenkinsClient.JenkinsV1().Releases(namespace)
+				startInformer("releases", &jenkinsxv1.Release{}, &cache.ListWatch{
+					ListFunc: func(opts metav1.ListOptions) (runtime.Object, error) {
+						return releases.List(opts)
+					},
+					WatchFunc: releases.Watch,
+				}, cache.ResourceEventHandlerFuncs{AddFunc: func(obj interface{}) {
+					if release, ok := obj.(*jenkinsxv1.Release); ok {
+						linkCreatedRelease(namespace, release)
+					}
+				}})
+			}
+			time.Sleep(namespacesInterval)
+		}
+	}()
+}
+
+// linkCreatedRelease annotates a new Release if the version it was made of has reports in the team's namespace
+func linkCreatedRelease(namespace string, release *jenkinsxv1.Release) {
+	org, app := release.Spec.GitOwner, release.Spec.GitRepository
+	if app == "" {
+		app = release.Spec.Name
+	}
+	if org == "" || app == "" || appNamespace(org, app) != namespace {
+		return
+	}
+	m, err := loadAppManifest(org, app)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	for _, v := range m.Versions {
+		if trimVersion(v.Version) != trimVersion(release.Spec.Version) {
+			continue
+		}
+		err = annotateRelease(release, org, app, v.Version)
+		if err != nil {
+			log.Printf("Failed to annotate Release %s: %s\n", release.Name, err)
+		}
+		return
+	}
+}
+
+// versionRelease returns the Release made of a version for the portal, or nil if there isn't one or it can't be read
+func versionRelease(org string, app string, version string) *jenkinsxv1.Release {
+	if jenkinsClient == nil {
+		return nil
+	}
+	list, err := jenkinsClient.JenkinsV1().Releases(appNamespace(org, app)).List(metav1.ListOptions{})
+	if observeKubernetes("list_releases", err) != nil {
+		log.Println(err)
+		return nil
+	}
+	return findRelease(list.Items, org, app, version)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+var junitTemplate = template.Must(template.New("junit").Parse(junitTemplateText))
+
+// junitPage is the model the JUnit template is rendered with
+type junitPage struct {
+	Title  string
+	Path   string
+	Filter string
+	Totals testTotals
+	Suites []junitSuiteView
+}
+
+type junitSuiteView struct {
+	Name      string
+	Totals    testTotals
+	Cases     []junitCaseView
+	SystemOut string
+	SystemErr string
+}
+
+type junitCaseView struct {
+	Name      string
+	Classname string
+	Time      float64
+	Status    string
+	Result    *junitResult
+	SystemOut string
+	SystemErr string
+}
+
+// reportFileHandler serves the stored reports. Browsers asking for text/html get the portal for the org, app and
+// version directories and recognised report types rendered as HTML, anyone else, or anyone adding ?raw=1, gets the
+// directory listing or the file as it was uploaded.
+func reportFileHandler() http.HandlerFunc {
+	root := teamFileSystem{}
+	files := http.FileServer(root)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wantsRendered(r) && strings.HasSuffix(r.URL.Path, "/") && renderPortal(w, r) {
+			return
+		}
+		if !wantsRendered(r) || path.Ext(r.URL.Path) != ".xml" {
+			if !serveCompressed(w, r, root) {
+				files.ServeHTTP(w, r)
+			}
+			return
+		}
+		f, err := root.Open(r.URL.Path)
+		if err != nil {
+			files.ServeHTTP(w, r)
+			return
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			files.ServeHTTP(w, r)
+			return
+		}
+		if rootElement, err := xmlRootElement(data); err != nil || (rootElement != "testsuite" && rootElement != "testsuites") {
+			files.ServeHTTP(w, r)
+			return
+		}
+		suites, err := parseJUnit(data)
+		if err != nil {
+			log.Println(err)
+			files.ServeHTTP(w, r)
+			return
+		}
+		page := newJUnitPage(r.URL.Path, suites, r.URL.Query().Get("status"))
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Vary", "Accept")
+		err = junitTemplate.Execute(w, page)
+		if err != nil {
+			log.Println(err)
+		}
+	})
+}
+
+func wantsRendered(r *http.Request) bool {
+	raw := r.URL.Query().Get("raw")
+	if raw == "1" || raw == "true" {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// newJUnitPage builds the page model, keeping only the test cases matching the status filter. Errors are shown
+// as failures when filtering, as that is what anyone looking for broken tests is after.
+func newJUnitPage(reportPath string, suites []junitTestSuite, filter string) *junitPage {
+	page := &junitPage{
+		Title:  path.Base(reportPath),
+		Path:   reportPath,
+		Filter: filter,
+	}
+	for _, s := range suites {
+		report := &buildReport{}
+		report.addTests([]junitTestSuite{s})
+		suite := junitSuiteView{
+			Name:      s.Name,
+			Totals:    *report.Tests,
+			SystemOut: strings.TrimSpace(s.SystemOut),
+			SystemErr: strings.TrimSpace(s.SystemErr),
+		}
+		for _, tc := range s.TestCases {
+			status := tc.Status()
+			if !matchesStatusFilter(status, filter) {
+				continue
+			}
+			view := junitCaseView{
+				Name:      tc.Name,
+				Classname: tc.Classname,
+				Time:      tc.Duration(),
+				Status:    status,
+				SystemOut: strings.TrimSpace(tc.SystemOut),
+				SystemErr: strings.TrimSpace(tc.SystemErr),
+			}
+			switch status {
+			case testStatusFailed:
+				view.Result = tc.Failure
+			case testStatusError:
+				view.Result = tc.Error
+			case testStatusSkipped:
+				view.Result = tc.Skipped
+			}
+			suite.Cases = append(suite.Cases, view)
+		}
+		page.Totals.Tests += suite.Totals.Tests
+		page.Totals.Passed += suite.Totals.Passed
+		page.Totals.Failures += suite.Totals.Failures
+		page.Totals.Errors += suite.Totals.Errors
+		page.Totals.Skipped += suite.Totals.Skipped
+		page.Totals.Time += suite.Totals.Time
+		page.Suites = append(page.Suites, suite)
+	}
+	return page
+}
+
+func matchesStatusFilter(status string, filter string) bool {
+	switch filter {
+	case "":
+		return true
+	case testStatusFailed:
+		return isFailure(status)
+	}
+	return status == filter
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	jenkinsxv1 "github.com/jenkins-x/jx/pkg/apis/jenkins.io/v1"
+	"io/ioutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionPolicy decides which builds are removed by the garbage collector. A build is kept if its version is one
+// of the last Versions versions of its app, if a jenkins.io/v1 Release was made of its version, or if it is younger
+// than the age for its branch: PRBuildAge for pull requests and BuildAge for master, release and other branches.
+// Builds of older versions are removed once they are older than the age for their branch, or straight away if no
+// age is set for it but Versions is. Unset limits don't remove anything.
+type retentionPolicy struct {
+	Versions   int
+	BuildAge   time.Duration
+	PRBuildAge time.Duration
+	Interval   time.Duration
+	DryRun     bool
+}
+
+// gcReport lists what a garbage collection removed, or would have removed in a dry run
+type gcReport struct {
+	DryRun   bool            `json:"dryRun"`
+	Started  time.Time       `json:"started"`
+	Finished time.Time       `json:"finished"`
+	Removed  []*removedBuild `json:"removed"`
+	// Blobs is how many blobs no report file links to any more were removed, and BlobBytes what they took up. A
+	// dry run only counts the blobs that are unreferenced already.
+	Blobs     int   `json:"blobs"`
+	BlobBytes int64 `json:"blobBytes"`
+}
+
+// removedBuild is a build removed by the garbage collector along with its report files and index documents. Report
+// files are shared by the builds of a version, so they are only removed with the last build that lists them.
+type removedBuild struct {
+	Org       string   `json:"org"`
+	App       string   `json:"app"`
+	Version   string   `json:"version"`
+	Branch    string   `json:"branch"`
+	Build     string   `json:"build"`
+	Reason    string   `json:"reason"`
+	Files     []string `json:"files,omitempty"`
+	Documents int      `json:"documents"`
+}
+
+// loadRetentionPolicy reads the policy from RETENTION_VERSIONS, RETENTION_BUILD_AGE, RETENTION_PR_BUILD_AGE,
+// RETENTION_INTERVAL and RETENTION_DRY_RUN, ages and the interval being durations such as 720h
+func loadRetentionPolicy() retentionPolicy {
+	policy := retentionPolicy{Interval: time.Hour, DryRun: os.Getenv("RETENTION_DRY_RUN") == "true"}
+	if versions, err := strconv.Atoi(os.Getenv("RETENTION_VERSIONS")); err == nil && versions > 0 {
+		policy.Versions = versions
+	}
+	if age, err := time.ParseDuration(os.Getenv("RETENTION_BUILD_AGE")); err == nil && age > 0 {
+		policy.BuildAge = age
+	}
+	if age, err := time.ParseDuration(os.Getenv("RETENTION_PR_BUILD_AGE")); err == nil && age > 0 {
+		policy.PRBuildAge = age
+	}
+	if interval, err := time.ParseDuration(os.Getenv("RETENTION_INTERVAL")); err == nil && interval > 0 {
+		policy.Interval = interval
+	}
+	return policy
+}
+
+func (policy retentionPolicy) enabled() bool {
+	return policy.Versions > 0 || policy.BuildAge > 0 || policy.PRBuildAge > 0
+}
+
+// maxAge is how long builds of a branch are kept once their version isn't one of the last versions
+func (policy retentionPolicy) maxAge(branch string) time.Duration {
+	if strings.HasPrefix(branch, "PR-") {
+		return policy.PRBuildAge
+	}
+	return policy.BuildAge
+}
+
+// expired tells why a build of the version ranked rank, most recent first, is to be removed, or "" if it is kept
+func (policy retentionPolicy) expired(rank int, b *buildManifest, now time.Time) string {
+	if policy.Versions > 0 && rank < policy.Versions {
+		return ""
+	}
+	maxAge := policy.maxAge(b.Branch)
+	if maxAge > 0 {
+		if now.Sub(b.Updated) < maxAge {
+			return ""
+		}
+		return fmt.Sprintf("older than %s", maxAge)
+	}
+	if policy.Versions > 0 {
+		return fmt.Sprintf("not one of the last %d versions", policy.Versions)
+	}
+	return ""
+}
+
+// collectGarbagePeriodically applies the retention policy every interval, logging what a dry run would remove
+func collectGarbagePeriodically(policy retentionPolicy) {
+	log.Printf("Collecting garbage every %s\n", policy.Interval)
+	for {
+		time.Sleep(policy.Interval)
+		report, err := collectGarbage(policy)
+		if err != nil {
+			log.Printf("Failed to collect garbage: %s\n", err)
+		}
+		if report == nil {
+			continue
+		}
+		if !policy.DryRun {
+			if len(report.Removed) > 0 || report.Blobs > 0 {
+				log.Printf("Garbage collection removed %d builds and %d blobs (%d bytes)\n", len(report.Removed),
+					report.Blobs, report.BlobBytes)
+			}
+			continue
+		}
+		for _, rb := range report.Removed {
+			log.Printf("Garbage collection would remove build %s of %s/%s %s: %s\n", buildKey(rb.Branch, rb.Build),
+				rb.Org, rb.App, rb.Version, rb.Reason)
+		}
+	}
+}
+
+// collectGarbage removes the builds the retention policy doesn't keep from every app: their report files, build
+// records, manifest entries, local index and sink documents, and their versions from the ConfigMap once no build of
+// them is left. The blobs no report file links to any more go last. Nothing is removed in a dry run, the report
+// tells what would be.
+func collectGarbage(policy retentionPolicy) (*gcReport, error) {
+	report := &gcReport{DryRun: policy.DryRun, Started: time.Now().UTC(), Removed: []*removedBuild{}}
+	var err error
+	if policy.enabled() {
+		err = removeExpiredBuilds(policy, report)
+	}
+	if err == nil {
+		report.Blobs, report.BlobBytes, err = collectBlobs(policy.DryRun)
+	}
+	report.Finished = time.Now().UTC()
+	return report, err
+}
+
+func removeExpiredBuilds(policy retentionPolicy, report *gcReport) error {
+	releases := map[string][]jenkinsxv1.Release{}
+	orgs, err := listOrgs()
+	if err != nil {
+		return err
+	}
+	for _, org := range orgs {
+		apps, err := listApps(org)
+		if err != nil {
+			return err
+		}
+		for _, app := range apps {
+			namespace := appNamespace(org, app)
+			if _, ok := releases[namespace]; !ok {
+				// without the Releases nothing can be removed safely
+				list, err := jenkinsClient.JenkinsV1().Releases(namespace).List(metav1.ListOptions{})
+				if err != nil {
+					return observeKubernetes("list_releases", err)
+				}
+				releases[namespace] = list.Items
+			}
+			released := releases[namespace]
+			now := time.Now().UTC()
+			removed, err := pruneAppBuilds(org, app, keepReleased(released, org, app,
+				func(rank int, v *versionManifest, b *buildManifest) string {
+					return policy.expired(rank, b, now)
+				}), policy.DryRun, false)
+			report.Removed = append(report.Removed, removed...)
+			if !policy.DryRun {
+				retentionRemovedBuildsTotal.add(float64(len(removed)), org)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isReleased tells whether one of the Releases was made of a version of an app
+func isReleased(releases []jenkinsxv1.Release, org string, app string, version string) bool {
+	return findRelease(releases, org, app, version) != nil
+}
+
+// keepReleased keeps the builds of the versions one of the Releases was made of from expiring
+func keepReleased(releases []jenkinsxv1.Release, org string, app string, expire buildExpiry) buildExpiry {
+	return func(rank int, v *versionManifest, b *buildManifest) string {
+		if isReleased(releases, org, app, v.Version) {
+			return ""
+		}
+		return expire(rank, v, b)
+	}
+}
+
+// buildExpiry tells why a build of the version ranked rank, most recent first, is to be removed, or "" if it is kept
+type buildExpiry func(rank int, v *versionManifest, b *buildManifest) string
+
+// pruneAppBuilds removes the builds of an app expire gives a reason for, along with their documents in the sinks
+// and their versions in the ConfigMap. Archiving moves the files under .archive of their storage root rather than
+// deleting them. Nothing is changed in a dry run.
+func pruneAppBuilds(org string, app string, expire buildExpiry, dryRun bool, archive bool) ([]*removedBuild, error) {
+	// builds are only changed by updateBuildRecord, which can't run while the app is pruned
+	buildsLock.Lock()
+	removed, versions, docs, err := removeAppBuilds(org, app, expire, dryRun, archive)
+	buildsLock.Unlock()
+	if !dryRun && len(removed) > 0 {
+		forgetUsage(org, app)
+	}
+	if err != nil || dryRun || len(removed) == 0 {
+		return removed, err
+	}
+	deleteFromIndexSinks(docs)
+	return removed, pruneConfigMap(org, app, versions)
+}
+
+// removeAppBuilds removes the expired builds of an app from the disk and its manifest, returning them along with
+// the manifest entries of the versions they belonged to, which are nil for versions that are gone altogether, and
+// the documents they had in the index
+func removeAppBuilds(org string, app string, expire buildExpiry, dryRun bool, archive bool) ([]*removedBuild, map[string]*versionManifest, []indexDocument, error) {
+	m, err := loadAppManifest(org, app)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var removed []*removedBuild
+	versions := map[string]*versionManifest{}
+	var docs []indexDocument
+	for rank, v := range m.versionsByBuilds() {
+		var expired []*removedBuild
+		for key, b := range v.Builds {
+			reason := expire(rank, v, b)
+			if reason == "" {
+				continue
+			}
+			expired = append(expired, &removedBuild{Org: org, App: app, Version: v.Version, Branch: b.Branch,
+				Build: b.Build, Reason: reason})
+			delete(v.Builds, key)
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		// the report files still listed by a build that is kept stay
+		listed := map[string]bool{}
+		for _, b := range v.Builds {
+			for _, name := range b.Reports {
+				listed[name] = true
+			}
+		}
+		sort.Slice(expired, func(i, j int) bool {
+			return buildKey(expired[i].Branch, expired[i].Build) < buildKey(expired[j].Branch, expired[j].Build)
+		})
+		for _, rb := range expired {
+			b, err := loadBuildRecord(org, app, rb.Branch, rb.Build)
+			if err != nil {
+				return removed, nil, nil, err
+			}
+			for _, report := range b.sortedReports() {
+				if !listed[report.Name] {
+					listed[report.Name] = true
+					rb.Files = append(rb.Files, report.Name)
+				}
+			}
+			buildDocs, err := indexedDocuments(org, app, rb.Branch, rb.Build)
+			if err != nil {
+				return removed, nil, nil, err
+			}
+			rb.Documents = len(buildDocs)
+			docs = append(docs, buildDocs...)
+			if !dryRun {
+				err = removeBuild(rb, archive)
+				if err != nil {
+					return removed, nil, nil, err
+				}
+			}
+			removed = append(removed, rb)
+		}
+		if len(v.Builds) == 0 {
+			delete(m.Versions, v.Version)
+			versions[v.Version] = nil
+			if !dryRun {
+				removeEmptyDir(filepath.Join(appUploadPath(org, app), org, app, v.Version))
+			}
+			continue
+		}
+		for _, rb := range expired {
+			for _, name := range rb.Files {
+				delete(v.Reports, name)
+				delete(v.Checksums, name)
+			}
+		}
+		// versions keep the time of their last upload, removing builds doesn't make them any more recent
+		versions[v.Version] = v
+	}
+	if dryRun || len(removed) == 0 {
+		return removed, versions, docs, nil
+	}
+	manifestLock.Lock()
+	defer manifestLock.Unlock()
+	return removed, versions, docs, writeJSON(manifestFile(org, app), m)
+}
+
+// removeBuild removes or archives the report files, local index and record of a build
+func removeBuild(rb *removedBuild, archive bool) error {
+	uploads, data := appUploadPath(rb.Org, rb.App), appDataPath(rb.Org, rb.App)
+	for _, name := range rb.Files {
+		for _, stored := range []string{name, name + compressedSuffix} {
+			err := discard(uploads, filepath.Join(uploads, rb.Org, rb.App, rb.Version, stored), archive)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := discard(data, filepath.Join(indexDir(rb.Org, rb.App), storeKey(rb.Branch), storeKey(rb.Build)), archive)
+	if err != nil {
+		return err
+	}
+	return discard(data, buildFile(rb.Org, rb.App, rb.Branch, rb.Build), archive)
+}
+
+// discard removes a file or directory within a storage root, or moves it to the same place under .archive of the
+// root, where it is neither served nor reindexed
+func discard(root string, path string, archive bool) error {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if !archive {
+		return os.RemoveAll(path)
+	}
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return err
+	}
+	archived := filepath.Join(root, archiveDir, rel)
+	err = os.MkdirAll(filepath.Dir(archived), os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	// a build archived before and uploaded to again replaces its earlier archive
+	err = os.RemoveAll(archived)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path, archived)
+}
+
+// removeEmptyDir removes a directory if nothing is left in it
+func removeEmptyDir(dir string) {
+	files, err := ioutil.ReadDir(dir)
+	if err == nil && len(files) == 0 {
+		os.Remove(dir)
+	}
+}
+
+// indexedDocuments returns the documents of every report of a build in the local index
+func indexedDocuments(org string, app string, branch string, buildNo string) ([]indexDocument, error) {
+	dir := filepath.Join(indexDir(org, app), storeKey(branch), storeKey(buildNo))
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var docs []indexDocument
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		var reportDocs []indexDocument
+		err = readJSON(filepath.Join(dir, f.Name()), &reportDocs)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, reportDocs...)
+	}
+	return docs, nil
+}
+
+// pruneConfigMap drops the versions that are gone from the ConfigMap of an app and lists the reports left of the
+// others, which keeps it well below the size limit of Kubernetes objects
+func pruneConfigMap(org string, app string, versions map[string]*versionManifest) error {
+	cm, err := kubernetesClient.CoreV1().ConfigMaps(appNamespace(org, app)).Get(fmt.Sprintf("%s-%s-test-reports", org, app), metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return observeKubernetes("get_config_map", err)
+	}
+	for version, v := range versions {
+		if v == nil {
+			delete(cm.Data, version)
+			delete(cm.Data, version+".summary")
+			continue
+		}
+		setConfigMapVersion(cm, v)
+	}
+	_, err = kubernetesClient.CoreV1().ConfigMaps(cm.Namespace).Update(cm)
+	return observeKubernetes("update_config_map", err)
+}
@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bytes"
+	json2 "encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexSchemaVersion is part of the Elasticsearch index names so documents of a changed schema go to a new index
+const indexSchemaVersion = "v1"
+const sinkQueueSize = 1000
+
+// indexSink is a secondary store the documents of the local index are copied to
+type indexSink interface {
+	Name() string
+	Send(docs []indexDocument) error
+}
+
+// retryPolicy is how often and how patiently a sink retries failed sends, the backoff doubles after every attempt
+type retryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+}
+
+// sinkInstaller is implemented by sinks that have to prepare the store they send to before the first documents,
+// e.g. install an index template
+type sinkInstaller interface {
+	Install() error
+}
+
+// sinkWorker feeds one sink from its own queue, so a slow or unavailable sink doesn't hold up the others. Documents
+// are sent in batches of up to batchSize, or whatever has been queued after flushInterval. Without a flush interval
+// the documents of every report are sent on their own.
+type sinkWorker struct {
+	sink          indexSink
+	policy        retryPolicy
+	batchSize     int
+	flushInterval time.Duration
+	queue         chan sinkUpdate
+}
+
+// sinkUpdate is what the queue of a sink carries, the documents of a report and the documents they replace that are
+// gone. Documents are deleted before anything queued after them is sent.
+type sinkUpdate struct {
+	docs    []indexDocument
+	deleted []indexDocument
+}
+
+// sinkDeleter is implemented by sinks that can remove documents again, e.g. when the retention policy removes the
+// builds they came from. Time series sinks such as InfluxDB are left to their own retention policies.
+type sinkDeleter interface {
+	Delete(docs []indexDocument) error
+}
+
+// defaultElasticsearchURL is the Elasticsearch of the chart's jx namespace, which reports were always indexed to
+const defaultElasticsearchURL = "http://jenkins-x-reports-elasticsearch-client.jx:9200"
+
+var sinkWorkers []*sinkWorker
+var sinkWorkersDone sync.WaitGroup
+
+// startIndexSinks starts a worker for every enabled sink. Each sink is configured by environment variables with its
+// prefix, e.g. ELASTICSEARCH_URL, ELASTICSEARCH_ENABLED, ELASTICSEARCH_RETRIES, ELASTICSEARCH_RETRY_BACKOFF,
+// ELASTICSEARCH_BATCH_SIZE and ELASTICSEARCH_FLUSH_INTERVAL. Elasticsearch indexes to the in-cluster cluster unless
+// ELASTICSEARCH_URL says otherwise, as it always has, and ELASTICSEARCH_ENABLED=false turns it off.
+func startIndexSinks() {
+	configure := func(prefix string, defaultURL string, flushInterval time.Duration, newSink func(url string) indexSink) {
+		url := os.Getenv(prefix + "_URL")
+		if url == "" {
+			url = defaultURL
+		}
+		if url == "" || os.Getenv(prefix+"_ENABLED") == "false" {
+			return
+		}
+		worker := &sinkWorker{
+			sink:          newSink(url),
+			policy:        retryPolicy{Attempts: 3, Backoff: time.Second},
+			batchSize:     500,
+			flushInterval: flushInterval,
+			queue:         make(chan sinkUpdate, sinkQueueSize),
+		}
+		if attempts, err := strconv.Atoi(os.Getenv(prefix + "_RETRIES")); err == nil && attempts > 0 {
+			worker.policy.Attempts = attempts
+		}
+		if backoff, err := time.ParseDuration(os.Getenv(prefix + "_RETRY_BACKOFF")); err == nil {
+			worker.policy.Backoff = backoff
+		}
+		if batchSize, err := strconv.Atoi(os.Getenv(prefix + "_BATCH_SIZE")); err == nil && batchSize > 0 {
+			worker.batchSize = batchSize
+		}
+		if interval, err := time.ParseDuration(os.Getenv(prefix + "_FLUSH_INTERVAL")); err == nil {
+			worker.flushInterval = interval
+		}
+		sinkWorkers = append(sinkWorkers, worker)
+		sinkWorkersDone.Add(1)
+		go func() {
+			defer sinkWorkersDone.Done()
+			worker.run()
+		}()
+		log.Printf("Indexing to %s at %s\n", worker.sink.Name(), url)
+	}
+	configure("ELASTICSEARCH", defaultElasticsearchURL, 5*time.Second, func(url string) indexSink {
+		return newElasticsearchSink("elasticsearch", url, os.Getenv("ELASTICSEARCH_INDEX_PREFIX"),
+			os.Getenv("ELASTICSEARCH_INDEX_ROLLOVER"))
+	})
+	configure("OPENSEARCH", "", 5*time.Second, func(url string) indexSink {
+		return newElasticsearchSink("opensearch", url, os.Getenv("OPENSEARCH_INDEX_PREFIX"),
+			os.Getenv("OPENSEARCH_INDEX_ROLLOVER"))
+	})
+	configure("INFLUXDB", "", 5*time.Second, func(url string) indexSink {
+		return newInfluxDBSink(url)
+	})
+	configure("WEBHOOK", "", 0, func(url string) indexSink {
+		return newWebhookSink(url)
+	})
+}
+
+// feedIndexSinks queues documents for every sink, along with the documents of the same report that are gone,
+// dropping them for sinks whose queue is full
+func feedIndexSinks(docs []indexDocument, deleted []indexDocument) {
+	if len(docs) == 0 && len(deleted) == 0 {
+		return
+	}
+	for _, worker := range sinkWorkers {
+		select {
+		case worker.queue <- sinkUpdate{docs: docs, deleted: deleted}:
+		default:
+			indexDocumentsTotal.add(float64(len(docs)), worker.sink.Name(), "dropped")
+			log.Printf("Queue of %s is full, dropping %d documents\n", worker.sink.Name(), len(docs))
+		}
+	}
+}
+
+// waitToFeedIndexSinks queues documents for every sink like feedIndexSinks, but waits for sinks whose queue is full
+// rather than dropping them
+func waitToFeedIndexSinks(docs []indexDocument, deleted []indexDocument) {
+	if len(docs) == 0 && len(deleted) == 0 {
+		return
+	}
+	for _, worker := range sinkWorkers {
+		worker.queue <- sinkUpdate{docs: docs, deleted: deleted}
+	}
+}
+
+// stopIndexSinks sends whatever is still queued and waits for every sink to be done with it
+func stopIndexSinks() {
+	for _, worker := range sinkWorkers {
+		close(worker.queue)
+	}
+	sinkWorkersDone.Wait()
+}
+
+// deleteFromIndexSinks removes documents from every sink that can delete them. It doesn't go through the queues, so
+// it has to be called once the documents won't be sent again.
+func deleteFromIndexSinks(docs []indexDocument) {
+	if len(docs) == 0 {
+		return
+	}
+	for _, worker := range sinkWorkers {
+		worker.delete(docs)
+	}
+}
+
+func (worker *sinkWorker) run() {
+	if installer, ok := worker.sink.(sinkInstaller); ok {
+		err := worker.retry(installer.Install)
+		if err != nil {
+			log.Printf("Failed to prepare %s: %s\n", worker.sink.Name(), err)
+		}
+	}
+	if worker.flushInterval <= 0 {
+		for update := range worker.queue {
+			worker.delete(update.deleted)
+			worker.flush(update.docs)
+		}
+		return
+	}
+	ticker := time.NewTicker(worker.flushInterval)
+	defer ticker.Stop()
+	var batch []indexDocument
+	for {
+		select {
+		case update, ok := <-worker.queue:
+			if !ok {
+				worker.flush(batch)
+				return
+			}
+			if len(update.deleted) > 0 {
+				// what is batched may be what is to be deleted
+				worker.flush(batch)
+				batch = nil
+				worker.delete(update.deleted)
+			}
+			batch = append(batch, update.docs...)
+			if len(batch) >= worker.batchSize {
+				worker.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			worker.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+func (worker *sinkWorker) flush(docs []indexDocument) {
+	for len(docs) > 0 {
+		batch := docs
+		if worker.batchSize > 0 && len(batch) > worker.batchSize {
+			batch = docs[:worker.batchSize]
+		}
+		docs = docs[len(batch):]
+		err := worker.retry(func() error {
+			return worker.sink.Send(batch)
+		})
+		if err != nil {
+			indexErrorsTotal.add(1, worker.sink.Name())
+			indexDocumentsTotal.add(float64(len(batch)), worker.sink.Name(), "error")
+			log.Printf("Failed to send %d documents to %s: %s\n", len(batch), worker.sink.Name(), err)
+		} else {
+			indexDocumentsTotal.add(float64(len(batch)), worker.sink.Name(), "success")
+		}
+	}
+}
+
+// delete removes documents from the sink, if it can delete them
+func (worker *sinkWorker) delete(docs []indexDocument) {
+	deleter, ok := worker.sink.(sinkDeleter)
+	if !ok || len(docs) == 0 {
+		return
+	}
+	err := worker.retry(func() error {
+		return deleter.Delete(docs)
+	})
+	if err != nil {
+		indexErrorsTotal.add(1, worker.sink.Name())
+		indexDocumentsTotal.add(float64(len(docs)), worker.sink.Name(), "delete_error")
+		log.Printf("Failed to delete %d documents from %s: %s\n", len(docs), worker.sink.Name(), err)
+	} else {
+		indexDocumentsTotal.add(float64(len(docs)), worker.sink.Name(), "deleted")
+	}
+}
+
+// retry calls f until it succeeds or the attempts of the retry policy are used up
+func (worker *sinkWorker) retry(f func() error) error {
+	backoff := worker.policy.Backoff
+	var err error
+	for attempt := 1; attempt <= worker.policy.Attempts; attempt++ {
+		err = f()
+		if err == nil {
+			return nil
+		}
+		if attempt < worker.policy.Attempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// postToSink posts a body to url, failing for anything but a 2xx response
+func postToSink(client *http.Client, url string, contentType string, body []byte) error {
+	return checkSinkResponse(client.Post(url, contentType, bytes.NewReader(body)))
+}
+
+func checkSinkResponse(resp *http.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return errors.New(fmt.Sprintf("HTTP status: %s; HTTP Body: %s", resp.Status, data))
+	}
+	return nil
+}
+
+// elasticsearchSink indexes documents with the bulk API into daily or monthly indices, which an index template
+// installed at startup maps and adds to an alias named after the prefix. Documents go to the index of the time
+// their build started, so sending them again overwrites them. OpenSearch speaks the same API.
+type elasticsearchSink struct {
+	name     string
+	url      string
+	prefix   string
+	rollover string
+	client   *http.Client
+}
+
+func newElasticsearchSink(name string, url string, prefix string, rollover string) *elasticsearchSink {
+	if prefix == "" {
+		prefix = "jenkins-x-reports"
+	}
+	if rollover != "daily" {
+		rollover = "monthly"
+	}
+	return &elasticsearchSink{
+		name:     name,
+		url:      strings.TrimSuffix(url, "/"),
+		prefix:   prefix,
+		rollover: rollover,
+		client:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (s *elasticsearchSink) Name() string {
+	return s.name
+}
+
+// index is the index a document goes to, versioned so documents of a changed schema go to new indices, and rolled
+// over by the day or month of its build
+func (s *elasticsearchSink) index(doc *indexDocument) string {
+	layout := "2006.01"
+	if s.rollover == "daily" {
+		layout = "2006.01.02"
+	}
+	t := doc.BuildTime
+	if t.IsZero() {
+		t = doc.Timestamp
+	}
+	return fmt.Sprintf("%s-%s-%s", s.prefix, indexSchemaVersion, t.UTC().Format(layout))
+}
+
+// Ping checks the cluster can be reached
+func (s *elasticsearchSink) Ping() error {
+	return checkSinkResponse(s.client.Get(s.url))
+}
+
+// Install puts the index template for the indices of the current schema version
+func (s *elasticsearchSink) Install() error {
+	keyword := map[string]string{"type": "keyword"}
+	integer := map[string]string{"type": "integer"}
+	double := map[string]string{"type": "double"}
+	totals := map[string]interface{}{
+		"properties": map[string]interface{}{
+			"tests": integer, "passed": integer, "failures": integer, "errors": integer, "skipped": integer,
+			"time": double,
+		},
+	}
+	template := map[string]interface{}{
+		"index_patterns": []string{fmt.Sprintf("%s-%s-*", s.prefix, indexSchemaVersion)},
+		"aliases": map[string]interface{}{
+			s.prefix: map[string]interface{}{},
+		},
+		"mappings": map[string]interface{}{
+			"dynamic": false,
+			"properties": map[string]interface{}{
+				"id":        keyword,
+				"kind":      keyword,
+				"org":       keyword,
+				"app":       keyword,
+				"version":   keyword,
+				"branch":    keyword,
+				"build":     keyword,
+				"file":      keyword,
+				"commitSHA": keyword,
+				"buildTime": map[string]string{"type": "date"},
+				"timestamp": map[string]string{"type": "date"},
+				"suite":     keyword,
+				"name": map[string]interface{}{
+					"type":   "text",
+					"fields": map[string]interface{}{"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 1024}},
+				},
+				"classname": keyword,
+				"status":    keyword,
+				"duration":  double,
+				"message":   map[string]string{"type": "text"},
+				"tests":     totals,
+				"coverage": map[string]interface{}{
+					"properties": map[string]interface{}{"lines": integer, "covered": integer, "percent": double},
+				},
+				"severity": keyword,
+				"rule":     keyword,
+				"location": keyword,
+			},
+		},
+	}
+	body, err := json2.Marshal(template)
+	if err != nil {
+		return err
+	}
+	url := fmt.Sprintf("%s/_template/%s-%s", s.url, s.prefix, indexSchemaVersion)
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return checkSinkResponse(s.client.Do(req))
+}
+
+// elasticsearchBulkResponse is the part of a bulk response needed to tell whether every document was indexed
+type elasticsearchBulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int              `json:"status"`
+		Error  json2.RawMessage `json:"error"`
+	} `json:"items"`
+}
+
+func (s *elasticsearchSink) Send(docs []indexDocument) error {
+	var body bytes.Buffer
+	for i := range docs {
+		action, err := json2.Marshal(map[string]interface{}{
+			"index": map[string]string{"_index": s.index(&docs[i]), "_id": docs[i].ID},
+		})
+		if err != nil {
+			return err
+		}
+		doc, err := json2.Marshal(docs[i])
+		if err != nil {
+			return err
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+	return s.bulk(&body, len(docs))
+}
+
+// Delete removes documents from the index of the time their build started, documents that are already gone are
+// fine
+func (s *elasticsearchSink) Delete(docs []indexDocument) error {
+	var body bytes.Buffer
+	for i := range docs {
+		action, err := json2.Marshal(map[string]interface{}{
+			"delete": map[string]string{"_index": s.index(&docs[i]), "_id": docs[i].ID},
+		})
+		if err != nil {
+			return err
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+	}
+	return s.bulk(&body, len(docs))
+}
+
+// bulk posts the actions of body to the bulk API, failing unless every one of the count actions succeeded
+func (s *elasticsearchSink) bulk(body *bytes.Buffer, count int) error {
+	resp, err := s.client.Post(s.url+"/_bulk", "application/x-ndjson", body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("HTTP status: %s; HTTP Body: %s", resp.Status, data))
+	}
+	var result elasticsearchBulkResponse
+	err = json2.Unmarshal(data, &result)
+	if err != nil {
+		return err
+	}
+	if !result.Errors {
+		return nil
+	}
+	failed := 0
+	var first json2.RawMessage
+	for _, item := range result.Items {
+		for _, outcome := range item {
+			if outcome.Status >= 300 && outcome.Status != http.StatusNotFound {
+				if failed == 0 {
+					first = outcome.Error
+				}
+				failed++
+			}
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("%d of %d documents failed, first error: %s", failed, count, first))
+}
+
+// influxDBSink writes the numbers of the documents as InfluxDB line protocol, the url is the write endpoint
+// including the database, e.g. http://influxdb:8086/write?db=reports
+type influxDBSink struct {
+	url    string
+	client *http.Client
+}
+
+func newInfluxDBSink(url string) *influxDBSink {
+	return &influxDBSink{url: url, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (s *influxDBSink) Name() string {
+	return "influxdb"
+}
+
+func (s *influxDBSink) Send(docs []indexDocument) error {
+	var lines bytes.Buffer
+	// findings are counted per build, batches can hold the documents of several
+	type findingsKey struct{ org, app, branch, version, build string }
+	findings := map[findingsKey]map[string]int{}
+	var builds []findingsKey
+	first := map[findingsKey]*indexDocument{}
+	for i := range docs {
+		doc := &docs[i]
+		tags := []string{"org=" + lineProtocolEscape(doc.Org), "app=" + lineProtocolEscape(doc.App),
+			"branch=" + lineProtocolEscape(doc.Branch)}
+		var fields []string
+		switch doc.Kind {
+		case docKindSuite:
+			tags = append(tags, "suite="+lineProtocolEscape(doc.Suite))
+			fields = []string{
+				fmt.Sprintf("tests=%di", doc.Tests.Tests),
+				fmt.Sprintf("passed=%di", doc.Tests.Passed),
+				fmt.Sprintf("failures=%di", doc.Tests.Failures),
+				fmt.Sprintf("errors=%di", doc.Tests.Errors),
+				fmt.Sprintf("skipped=%di", doc.Tests.Skipped),
+				fmt.Sprintf("time=%g", doc.Tests.Time),
+			}
+		case docKindTestCase:
+			// every test case is a series of its own, points of one series with the same timestamp overwrite each other
+			tags = append(tags, "suite="+lineProtocolEscape(doc.Suite), "classname="+lineProtocolEscape(doc.Classname),
+				"name="+lineProtocolEscape(doc.Name), "status="+lineProtocolEscape(doc.Status))
+			fields = []string{fmt.Sprintf("duration=%g", doc.Duration)}
+		case docKindCoverage:
+			fields = []string{
+				fmt.Sprintf("percent=%g", doc.Coverage.Percent),
+				fmt.Sprintf("lines=%di", doc.Coverage.Lines),
+				fmt.Sprintf("covered=%di", doc.Coverage.Covered),
+			}
+		case docKindFinding:
+			// findings are only counted, one point per build and severity
+			key := findingsKey{doc.Org, doc.App, doc.Branch, doc.Version, doc.Build}
+			if findings[key] == nil {
+				findings[key] = map[string]int{}
+				builds = append(builds, key)
+				first[key] = doc
+			}
+			findings[key][doc.Severity]++
+			continue
+		default:
+			continue
+		}
+		fields = append(fields, "version="+strconv.Quote(doc.Version), "build="+strconv.Quote(doc.Build))
+		fmt.Fprintf(&lines, "%s,%s %s %d\n", doc.Kind, strings.Join(tags, ","), strings.Join(fields, ","),
+			doc.Timestamp.UnixNano())
+	}
+	for _, key := range builds {
+		doc := first[key]
+		for _, severity := range []string{severityCritical, severityMajor, severityMinor} {
+			if findings[key][severity] == 0 {
+				continue
+			}
+			fmt.Fprintf(&lines, "findings,org=%s,app=%s,branch=%s,severity=%s count=%di,version=%s,build=%s %d\n",
+				lineProtocolEscape(doc.Org), lineProtocolEscape(doc.App), lineProtocolEscape(doc.Branch), severity,
+				findings[key][severity], strconv.Quote(doc.Version), strconv.Quote(doc.Build), doc.Timestamp.UnixNano())
+		}
+	}
+	if lines.Len() == 0 {
+		return nil
+	}
+	return postToSink(s.client, s.url, "text/plain; charset=utf-8", lines.Bytes())
+}
+
+// lineProtocolEscape escapes a tag value for the line protocol
+func lineProtocolEscape(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return strings.NewReplacer(",", "\\,", "=", "\\=", " ", "\\ ").Replace(value)
+}
+
+// webhookSink posts the documents of every report to a URL as a single JSON document
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookSink(url string) *webhookSink {
+	return &webhookSink{url: url, client: &http.Client{Timeout: 30 * time.Second}}
+}
+
+func (s *webhookSink) Name() string {
+	return "webhook"
+}
+
+func (s *webhookSink) Send(docs []indexDocument) error {
+	body, err := json2.Marshal(map[string]interface{}{
+		"documents": docs,
+	})
+	if err != nil {
+		return err
+	}
+	return postToSink(s.client, s.url, "application/json", body)
+}
+
+// Delete tells the webhook which documents are gone, by their IDs
+func (s *webhookSink) Delete(docs []indexDocument) error {
+	ids := []string{}
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+	body, err := json2.Marshal(map[string]interface{}{
+		"deleted": ids,
+	})
+	if err != nil {
+		return err
+	}
+	return postToSink(s.client, s.url, "application/json", body)
+}
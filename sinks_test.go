@@ -0,0 +1,344 @@
+package main
+
+import (
+	json2 "encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sinkRequest is a request received by a sink stand-in
+type sinkRequest struct {
+	method      string
+	path        string
+	query       string
+	contentType string
+	body        string
+}
+
+// sinkServer records the requests sent to it and answers each with status and response
+func sinkServer(t *testing.T, status int, response string) (*httptest.Server, *[]sinkRequest) {
+	var requests []sinkRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests = append(requests, sinkRequest{method: r.Method, path: r.URL.Path, query: r.URL.RawQuery,
+			contentType: r.Header.Get("Content-Type"), body: string(body)})
+		w.WriteHeader(status)
+		w.Write([]byte(response))
+	}))
+	return server, &requests
+}
+
+func sinkDocuments() []indexDocument {
+	buildTime := time.Date(2026, 3, 14, 9, 0, 0, 0, time.UTC)
+	doc := indexDocument{Org: "acme", App: "web app", Version: "1.2.3", Branch: "master", Build: "7",
+		BuildTime: buildTime, Timestamp: buildTime.Add(time.Minute)}
+	suite, testCase := doc, doc
+	suite.ID, suite.Kind, suite.Suite = "s1", docKindSuite, "unit"
+	suite.Tests = &testTotals{Tests: 3, Passed: 2, Failures: 1, Time: 1.5}
+	testCase.ID, testCase.Kind, testCase.Suite, testCase.Name = "t1", docKindTestCase, "unit", "TestLogin"
+	testCase.Status, testCase.Duration = testStatusFailed, 0.25
+	return []indexDocument{suite, testCase}
+}
+
+func TestElasticsearchSinkInstall(t *testing.T) {
+	server, requests := sinkServer(t, http.StatusOK, `{"acknowledged":true}`)
+	defer server.Close()
+	err := newElasticsearchSink("elasticsearch", server.URL+"/", "", "").Install()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(*requests))
+	}
+	request := (*requests)[0]
+	if request.method != http.MethodPut || request.path != "/_template/jenkins-x-reports-"+indexSchemaVersion {
+		t.Errorf("expected the template to be put, got %s %s", request.method, request.path)
+	}
+	var template struct {
+		IndexPatterns []string               `json:"index_patterns"`
+		Aliases       map[string]interface{} `json:"aliases"`
+	}
+	err = json2.Unmarshal([]byte(request.body), &template)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pattern := "jenkins-x-reports-" + indexSchemaVersion + "-*"
+	if len(template.IndexPatterns) != 1 || template.IndexPatterns[0] != pattern {
+		t.Errorf("expected index pattern %s, got %v", pattern, template.IndexPatterns)
+	}
+	if _, ok := template.Aliases["jenkins-x-reports"]; !ok {
+		t.Errorf("expected the jenkins-x-reports alias, got %v", template.Aliases)
+	}
+}
+
+func TestElasticsearchSinkSend(t *testing.T) {
+	server, requests := sinkServer(t, http.StatusOK, `{"errors":false,"items":[]}`)
+	defer server.Close()
+	err := newElasticsearchSink("elasticsearch", server.URL, "reports", "daily").Send(sinkDocuments())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(*requests))
+	}
+	request := (*requests)[0]
+	if request.path != "/_bulk" || request.contentType != "application/x-ndjson" {
+		t.Errorf("expected a bulk request, got %s as %s", request.path, request.contentType)
+	}
+	lines := strings.Split(strings.TrimSuffix(request.body, "\n"), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected an action and a document per document, got %d lines", len(lines))
+	}
+	index := "reports-" + indexSchemaVersion + "-2026.03.14"
+	for i, id := range []string{"s1", "t1"} {
+		var action map[string]map[string]string
+		err = json2.Unmarshal([]byte(lines[2*i]), &action)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if action["index"]["_index"] != index || action["index"]["_id"] != id {
+			t.Errorf("expected %s to be indexed to %s, got %s", id, index, lines[2*i])
+		}
+		var doc indexDocument
+		err = json2.Unmarshal([]byte(lines[2*i+1]), &doc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if doc.ID != id {
+			t.Errorf("expected document %s, got %s", id, doc.ID)
+		}
+	}
+}
+
+func TestElasticsearchSinkBulkFailures(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		status   int
+		response string
+		err      string
+	}{
+		{"all indexed", http.StatusOK, `{"errors":false}`, ""},
+		{"rejected request", http.StatusBadRequest, `{"error":"bad"}`, "HTTP status: 400"},
+		{"failed document", http.StatusOK, `{"errors":true,"items":[{"index":{"status":201}},` +
+			`{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}}]}`,
+			`1 of 2 documents failed, first error: {"type":"mapper_parsing_exception"}`},
+		{"missing document", http.StatusOK, `{"errors":true,"items":[{"delete":{"status":404}},` +
+			`{"delete":{"status":200}}]}`, ""},
+	} {
+		server, _ := sinkServer(t, test.status, test.response)
+		err := newElasticsearchSink("elasticsearch", server.URL, "", "").Delete(sinkDocuments())
+		server.Close()
+		if test.err == "" && err != nil {
+			t.Errorf("%s: expected no error, got %s", test.name, err)
+		}
+		if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+}
+
+func TestInfluxDBSinkSend(t *testing.T) {
+	server, requests := sinkServer(t, http.StatusNoContent, "")
+	defer server.Close()
+	docs := sinkDocuments()
+	err := newInfluxDBSink(server.URL + "/write?db=reports").Send(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(*requests))
+	}
+	request := (*requests)[0]
+	if request.path != "/write" || request.query != "db=reports" {
+		t.Errorf("expected a write to the reports database, got %s?%s", request.path, request.query)
+	}
+	ts := docs[0].Timestamp.UnixNano()
+	expected := strings.Join([]string{
+		`suite,org=acme,app=web\ app,branch=master,suite=unit tests=3i,passed=2i,failures=1i,errors=0i,skipped=0i,` +
+			`time=1.5,version="1.2.3",build="7" ` + strconv.FormatInt(ts, 10),
+		`testcase,org=acme,app=web\ app,branch=master,suite=unit,classname=none,name=TestLogin,status=failed ` +
+			`duration=0.25,version="1.2.3",build="7" ` + strconv.FormatInt(ts, 10),
+	}, "\n") + "\n"
+	if request.body != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, request.body)
+	}
+}
+
+func TestInfluxDBSinkTestCaseSeries(t *testing.T) {
+	server, requests := sinkServer(t, http.StatusNoContent, "")
+	defer server.Close()
+	docs := sinkDocuments()[1:]
+	other := docs[0]
+	other.ID, other.Name, other.Duration = "t2", "TestLogout", 0.5
+	docs = append(docs, other)
+	err := newInfluxDBSink(server.URL).Send(docs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(*requests))
+	}
+	// points of the same series and timestamp overwrite each other, so the cases of a suite need series of their own
+	series := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSuffix((*requests)[0].body, "\n"), "\n") {
+		parts := strings.Split(strings.Replace(line, "\\ ", "\\_", -1), " ")
+		if len(parts) != 3 {
+			t.Fatalf("unexpected point %s", line)
+		}
+		key := parts[0] + " " + parts[2]
+		if series[key] {
+			t.Errorf("%s is written twice", key)
+		}
+		series[key] = true
+	}
+	if len(series) != 2 {
+		t.Errorf("expected 2 points, got %d", len(series))
+	}
+}
+
+func TestInfluxDBSinkSendNothing(t *testing.T) {
+	server, requests := sinkServer(t, http.StatusNoContent, "")
+	defer server.Close()
+	err := newInfluxDBSink(server.URL).Send([]indexDocument{{Kind: "unknown"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 0 {
+		t.Errorf("expected no request without points, got %d", len(*requests))
+	}
+}
+
+func TestInfluxDBSinkFailure(t *testing.T) {
+	server, _ := sinkServer(t, http.StatusBadRequest, `{"error":"unable to parse"}`)
+	defer server.Close()
+	err := newInfluxDBSink(server.URL).Send(sinkDocuments())
+	if err == nil || !strings.Contains(err.Error(), "unable to parse") {
+		t.Errorf("expected the write to fail, got %v", err)
+	}
+}
+
+func TestLineProtocolEscape(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":          "none",
+		"acme":      "acme",
+		"a b,c=d":   `a\ b\,c\=d`,
+		"feature/x": "feature/x",
+	} {
+		if actual := lineProtocolEscape(value); actual != expected {
+			t.Errorf("expected %q to be escaped as %q, got %q", value, expected, actual)
+		}
+	}
+}
+
+func TestInfluxDBSinkFindingsPerBuild(t *testing.T) {
+	server, requests := sinkServer(t, http.StatusNoContent, "")
+	defer server.Close()
+	timestamp := time.Date(2026, 3, 14, 9, 0, 0, 0, time.UTC)
+	finding := func(app string, build string, severity string) indexDocument {
+		return indexDocument{Kind: docKindFinding, Org: "acme", App: app, Version: "1.0." + build, Branch: "master",
+			Build: build, Timestamp: timestamp, Severity: severity}
+	}
+	err := newInfluxDBSink(server.URL).Send([]indexDocument{
+		finding("web", "1", severityMajor),
+		finding("api", "4", severityCritical),
+		finding("web", "1", severityMajor),
+		finding("web", "2", severityMinor),
+		finding("api", "4", severityMajor),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(*requests))
+	}
+	ts := strconv.FormatInt(timestamp.UnixNano(), 10)
+	expected := strings.Join([]string{
+		`findings,org=acme,app=web,branch=master,severity=major count=2i,version="1.0.1",build="1" ` + ts,
+		`findings,org=acme,app=api,branch=master,severity=critical count=1i,version="1.0.4",build="4" ` + ts,
+		`findings,org=acme,app=api,branch=master,severity=major count=1i,version="1.0.4",build="4" ` + ts,
+		`findings,org=acme,app=web,branch=master,severity=minor count=1i,version="1.0.2",build="2" ` + ts,
+	}, "\n") + "\n"
+	if body := (*requests)[0].body; body != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, body)
+	}
+}
+
+// recordingSink records what is sent to it and deleted from it, as the IDs of the documents
+type recordingSink struct {
+	calls []string
+}
+
+func (s *recordingSink) Name() string {
+	return "recording"
+}
+
+func (s *recordingSink) Send(docs []indexDocument) error {
+	s.calls = append(s.calls, "send "+documentIDs(docs))
+	return nil
+}
+
+func (s *recordingSink) Delete(docs []indexDocument) error {
+	s.calls = append(s.calls, "delete "+documentIDs(docs))
+	return nil
+}
+
+func documentIDs(docs []indexDocument) string {
+	var ids []string
+	for _, doc := range docs {
+		ids = append(ids, doc.ID)
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestSinkWorkerDeletesBeforeLaterSends(t *testing.T) {
+	a, b, c := indexDocument{ID: "a"}, indexDocument{ID: "b"}, indexDocument{ID: "c"}
+	for _, test := range []struct {
+		flushInterval time.Duration
+		calls         []string
+	}{
+		{0, []string{"send a,b", "delete b", "send a", "send c"}},
+		{time.Hour, []string{"send a,b", "delete b", "send a,c"}},
+	} {
+		sink := &recordingSink{}
+		worker := &sinkWorker{sink: sink, policy: retryPolicy{Attempts: 1}, batchSize: 10,
+			flushInterval: test.flushInterval, queue: make(chan sinkUpdate, 3)}
+		worker.queue <- sinkUpdate{docs: []indexDocument{a, b}}
+		worker.queue <- sinkUpdate{docs: []indexDocument{a}, deleted: []indexDocument{b}}
+		worker.queue <- sinkUpdate{docs: []indexDocument{c}}
+		close(worker.queue)
+		worker.run()
+		if strings.Join(sink.calls, "; ") != strings.Join(test.calls, "; ") {
+			t.Errorf("flush interval %s: expected %v, got %v", test.flushInterval, test.calls, sink.calls)
+		}
+	}
+}
+
+func TestWaitToFeedIndexSinks(t *testing.T) {
+	sink := &recordingSink{}
+	worker := &sinkWorker{sink: sink, policy: retryPolicy{Attempts: 1}, queue: make(chan sinkUpdate, 1)}
+	sinkWorkers = []*sinkWorker{worker}
+	defer func() {
+		sinkWorkers = nil
+	}()
+	done := make(chan bool)
+	go func() {
+		worker.run()
+		done <- true
+	}()
+	for i := 0; i < 20; i++ {
+		waitToFeedIndexSinks([]indexDocument{{ID: strconv.Itoa(i)}}, nil)
+	}
+	close(worker.queue)
+	<-done
+	if len(sink.calls) != 20 {
+		t.Errorf("expected every document to be sent, got %v", sink.calls)
+	}
+}
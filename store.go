@@ -0,0 +1,52 @@
+package main
+
+import (
+	json2 "encoding/json"
+	"io/ioutil"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+)
+
+// readJSON loads the JSON document at path into v, leaving v untouched if the document doesn't exist yet
+func readJSON(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json2.Unmarshal(data, v)
+}
+
+// writeJSON stores v as a JSON document at path, replacing it atomically so readers never see a partial write
+func writeJSON(path string, v interface{}) error {
+	data, err := json2.Marshal(v)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, os.FileMode(0755))
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// storeKey escapes a value so it can be used as a single path segment, e.g. branch names containing '/'
+func storeKey(value string) string {
+	return neturl.PathEscape(value)
+}
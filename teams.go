@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"io/ioutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// teamsDir holds the storage of every team but the one of the default namespace, which keeps the top level
+const teamsDir = ".teams"
+
+// invalidTeam is the team of names that aren't valid, no namespace can be named like it so nothing is stored there
+const invalidTeam = ".invalid"
+
+const teamsConfigMap = "jenkins-x-reports-teams"
+const teamsKey = "teams.yaml"
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+var errAppOfAnotherTeam = errors.New("the app belongs to another team")
+var errAppNotAssigned = errors.New("the app isn't assigned to the team")
+
+// teamAssignments is read from the teams.yaml key of the jenkins-x-reports-teams ConfigMap, e.g.
+//
+//	jx-frontend: ["myorg/web", "myorg/web-*"]
+//	jx-backend: ["myorg/*-service"]
+//
+// mapping the namespace of each team to the org/app patterns of the apps it may claim. Apps the default namespace
+// doesn't already have are only given to a team they are assigned to.
+type teamAssignments struct {
+	namespaces map[string][]string
+	loaded     time.Time
+}
+
+var cachedTeamAssignments *teamAssignments
+
+var teamsLock sync.Mutex
+
+// appTeams maps org/app to the namespace of the team that uploaded reports for it first, apps that aren't listed
+// belong to the default namespace
+var appTeams map[string]string
+
+func teamsFile() string {
+	return filepath.Join(dataPath, "teams.json")
+}
+
+func loadAppTeams() (map[string]string, error) {
+	if appTeams != nil {
+		return appTeams, nil
+	}
+	teams := map[string]string{}
+	err := readJSON(teamsFile(), &teams)
+	if err != nil {
+		return nil, err
+	}
+	appTeams = teams
+	return teams, nil
+}
+
+// appNamespace returns the namespace of the team an app belongs to, which its ConfigMaps and PipelineActivities
+// are in
+func appNamespace(org string, app string) string {
+	teamsLock.Lock()
+	defer teamsLock.Unlock()
+	teams, err := loadAppTeams()
+	if err != nil {
+		log.Println(err)
+		return cmNamespace
+	}
+	if namespace, ok := teams[org+"/"+app]; ok {
+		return namespace
+	}
+	return cmNamespace
+}
+
+// claimApp makes sure an app belongs to the team of a namespace, giving it to the team if it is new and assigned to
+// the team
+func claimApp(org string, app string, namespace string) error {
+	if !validName(org) || !validName(app) {
+		return errors.New(fmt.Sprintf("invalid app %s/%s", org, app))
+	}
+	teamsLock.Lock()
+	defer teamsLock.Unlock()
+	teams, err := loadAppTeams()
+	if err != nil {
+		return err
+	}
+	key := org + "/" + app
+	if owner, ok := teams[key]; ok {
+		if owner != namespace {
+			return errAppOfAnotherTeam
+		}
+		return nil
+	}
+	if namespace == cmNamespace {
+		return nil
+	}
+	// apps uploaded before there were teams belong to the default namespace
+	if _, err := os.Stat(filepath.Join(dataPath, "manifests", org, storeKey(app)+".json")); err == nil {
+		return errAppOfAnotherTeam
+	}
+	assignments, err := loadTeamAssignments()
+	if err != nil {
+		return err
+	}
+	if !assignments.assigns(namespace, org, app) {
+		return errAppNotAssigned
+	}
+	updated := map[string]string{key: namespace}
+	for k, v := range teams {
+		updated[k] = v
+	}
+	err = writeJSON(teamsFile(), updated)
+	if err != nil {
+		return err
+	}
+	appTeams = updated
+	return nil
+}
+
+// loadTeamAssignments reads the ConfigMap again once the cached copy is older than a minute
+func loadTeamAssignments() (*teamAssignments, error) {
+	if cachedTeamAssignments != nil && time.Since(cachedTeamAssignments.loaded) < authCacheTTL {
+		return cachedTeamAssignments, nil
+	}
+	assignments := &teamAssignments{}
+	cm, err := kubernetesClient.CoreV1().ConfigMaps(cmNamespace).Get(teamsConfigMap, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return nil, observeKubernetes("get_config_map", err)
+	}
+	if err == nil {
+		err = yaml.Unmarshal([]byte(cm.Data[teamsKey]), &assignments.namespaces)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid %s in ConfigMap %s: %s", teamsKey, teamsConfigMap, err))
+		}
+	}
+	assignments.loaded = time.Now()
+	cachedTeamAssignments = assignments
+	return assignments, nil
+}
+
+// assigns tells whether an app is assigned to the team of a namespace
+func (assignments *teamAssignments) assigns(namespace string, org string, app string) bool {
+	for _, pattern := range assignments.namespaces[namespace] {
+		if matched, _ := path.Match(pattern, org+"/"+app); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// requestNamespace returns the namespace of the team uploading, which is the namespace of the authenticated
+// service account or token if it has one, the X-Namespace header, or the default namespace
+func requestNamespace(r *http.Request) (string, error) {
+	namespace := r.Header.Get("X-Namespace")
+	if identity := requestIdentity(r); identity != nil && identity.namespace() != "" {
+		if namespace != "" && namespace != identity.namespace() {
+			return "", errors.New(fmt.Sprintf("%s may not upload to namespace %s", identity.Name, namespace))
+		}
+		namespace = identity.namespace()
+	}
+	if namespace == "" {
+		return cmNamespace, nil
+	}
+	if !namespacePattern.MatchString(namespace) {
+		return "", errors.New(fmt.Sprintf("invalid namespace %s", namespace))
+	}
+	return namespace, nil
+}
+
+// teamRoot returns where the team of a namespace keeps its part of a storage root
+func teamRoot(root string, namespace string) string {
+	if namespace == cmNamespace {
+		return root
+	}
+	if !namespacePattern.MatchString(namespace) {
+		return filepath.Join(root, teamsDir, invalidTeam)
+	}
+	return filepath.Join(root, teamsDir, namespace)
+}
+
+// appRoot returns where the team an app belongs to keeps its part of a storage root. Requests are checked for valid
+// names long before, but names that would reach another team's storage through the reserved .teams and .blobs
+// directories, or step out of the root, get the root of no team.
+func appRoot(root string, org string, app string) string {
+	if !validName(org) || !validName(app) {
+		return filepath.Join(root, teamsDir, invalidTeam)
+	}
+	return teamRoot(root, appNamespace(org, app))
+}
+
+// appDataPath is the data directory of the team an app belongs to
+func appDataPath(org string, app string) string {
+	return appRoot(dataPath, org, app)
+}
+
+// appUploadPath is the report directory of the team an app belongs to
+func appUploadPath(org string, app string) string {
+	return appRoot(uploadPath, org, app)
+}
+
+// teamNamespaces returns the namespace of every team, the default namespace first
+func teamNamespaces() []string {
+	teamsLock.Lock()
+	defer teamsLock.Unlock()
+	namespaces := []string{cmNamespace}
+	teams, err := loadAppTeams()
+	if err != nil {
+		log.Println(err)
+		return namespaces
+	}
+	seen := map[string]bool{cmNamespace: true}
+	var others []string
+	for _, namespace := range teams {
+		if !seen[namespace] {
+			seen[namespace] = true
+			others = append(others, namespace)
+		}
+	}
+	sort.Strings(others)
+	return append(namespaces, others...)
+}
+
+// teamRoots returns the part of a storage root of every team
+func teamRoots(root string) []string {
+	var roots []string
+	for _, namespace := range teamNamespaces() {
+		roots = append(roots, teamRoot(root, namespace))
+	}
+	return roots
+}
+
+// teamFileSystem serves the reports of every team under /org/app/, as if they were all in one tree
+type teamFileSystem struct{}
+
+// Reports stored compressed are opened decompressed under the name they were uploaded with.
+func (fs teamFileSystem) Open(name string) (http.File, error) {
+	parts := splitPath(name)
+	for _, part := range parts {
+		if strings.HasPrefix(part, ".") {
+			return nil, os.ErrNotExist
+		}
+	}
+	if dir, name, ok := fs.reportDir(name); ok {
+		if strings.HasSuffix(name, compressedSuffix) {
+			return nil, os.ErrNotExist
+		}
+		f, err := dir.Open(name)
+		if os.IsNotExist(err) {
+			return openCompressed(dir, name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info, err := f.Stat(); err == nil && info.IsDir() {
+			return &storedDir{File: f, path: filepath.Join(string(dir), filepath.FromSlash(path.Clean("/"+name)))}, nil
+		}
+		return f, nil
+	}
+	// the top level and the orgs are spread over the teams
+	dir := &mergedDir{}
+	for _, root := range teamRoots(uploadPath) {
+		f, err := http.Dir(root).Open(name)
+		if err != nil {
+			continue
+		}
+		if dir.File == nil {
+			dir.File = f
+		} else {
+			dir.others = append(dir.others, f)
+		}
+	}
+	if dir.File == nil {
+		return nil, os.ErrNotExist
+	}
+	return dir, nil
+}
+
+// reportDir returns the storage root of the app a path below /org/app/ belongs to, and false for anything above
+func (teamFileSystem) reportDir(name string) (http.Dir, string, bool) {
+	parts := splitPath(name)
+	if len(parts) < 2 {
+		return "", "", false
+	}
+	for _, part := range parts {
+		if strings.HasPrefix(part, ".") {
+			return "", "", false
+		}
+	}
+	return http.Dir(appUploadPath(parts[0], parts[1])), name, true
+}
+
+// mergedDir lists the entries of the same directory in the storage of every team
+type mergedDir struct {
+	http.File
+	others []http.File
+}
+
+func (dir *mergedDir) Readdir(count int) ([]os.FileInfo, error) {
+	seen := map[string]bool{}
+	var infos []os.FileInfo
+	for _, f := range append([]http.File{dir.File}, dir.others...) {
+		entries, err := f.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range entries {
+			if strings.HasPrefix(info.Name(), ".") || seen[info.Name()] {
+				continue
+			}
+			seen[info.Name()] = true
+			infos = append(infos, info)
+		}
+	}
+	return infos, nil
+}
+
+func (dir *mergedDir) Close() error {
+	for _, f := range dir.others {
+		f.Close()
+	}
+	return dir.File.Close()
+}
+
+// listTeamEntries lists a directory in the storage of every team
+func listTeamEntries(root string, rel string) ([]os.FileInfo, error) {
+	var infos []os.FileInfo
+	for _, dir := range teamRoots(root) {
+		files, err := ioutil.ReadDir(filepath.Join(dir, rel))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, files...)
+	}
+	return infos, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTeams gives apps to teams and assigns apps to teams for the duration of a test, without touching storage
+func withTeams(teams map[string]string, assignments map[string][]string) func() {
+	teamsLock.Lock()
+	defer teamsLock.Unlock()
+	appTeams = teams
+	cachedTeamAssignments = &teamAssignments{namespaces: assignments, loaded: time.Now()}
+	return func() {
+		teamsLock.Lock()
+		defer teamsLock.Unlock()
+		appTeams, cachedTeamAssignments = nil, nil
+	}
+}
+
+func TestAppUploadPathIsolatesTeams(t *testing.T) {
+	defer withTeams(map[string]string{"myorg/web": "jx-frontend", "myorg/api": "jx-backend"}, nil)()
+	frontend := filepath.Join(uploadPath, teamsDir, "jx-frontend")
+	invalid := filepath.Join(uploadPath, teamsDir, invalidTeam)
+	for _, test := range []struct {
+		org  string
+		app  string
+		root string
+	}{
+		{"myorg", "web", frontend},
+		{"myorg", "api", filepath.Join(uploadPath, teamsDir, "jx-backend")},
+		{"myorg", "legacy", uploadPath},
+		{teamsDir, "jx-frontend", invalid},
+		{blobsDir, "ab", invalid},
+		{"myorg", "..", invalid},
+		{"..", "myorg", invalid},
+		{"myorg", "../web", invalid},
+		{"", "web", invalid},
+	} {
+		root := appUploadPath(test.org, test.app)
+		if root != test.root {
+			t.Errorf("expected %s/%s to be stored in %s, got %s", test.org, test.app, test.root, root)
+		}
+		// whatever invalid names are joined to, they stay out of the storage of the teams
+		dir := filepath.Join(root, test.org, test.app, "1.0.0")
+		if root == invalid && (strings.HasPrefix(dir, frontend) || !strings.HasPrefix(dir, uploadPath)) {
+			t.Errorf("%s/%s reaches %s", test.org, test.app, dir)
+		}
+	}
+	if root := teamRoot(uploadPath, "../jx-frontend"); root != invalid {
+		t.Errorf("expected an invalid namespace to get the root of no team, got %s", root)
+	}
+}
+
+func TestClaimApp(t *testing.T) {
+	defer withTeams(map[string]string{"myorg/web": "jx-frontend"},
+		map[string][]string{"jx-backend": {"myorg/*-service"}})()
+	for _, test := range []struct {
+		name      string
+		org       string
+		app       string
+		namespace string
+		err       error
+	}{
+		{"own app", "myorg", "web", "jx-frontend", nil},
+		{"app of another team", "myorg", "web", "jx-backend", errAppOfAnotherTeam},
+		{"app of a team for the default namespace", "myorg", "web", cmNamespace, errAppOfAnotherTeam},
+		{"unassigned app", "myorg", "billing", "jx-frontend", errAppNotAssigned},
+		{"app assigned to another team", "myorg", "billing-service", "jx-frontend", errAppNotAssigned},
+	} {
+		err := claimApp(test.org, test.app, test.namespace)
+		if err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+	if err := claimApp(teamsDir, "jx-frontend", "jx-backend"); err == nil {
+		t.Errorf("expected the storage of a team not to be claimable as an app")
+	}
+	if namespace := appNamespace("myorg", "billing"); namespace != cmNamespace {
+		t.Errorf("expected a failed claim to leave the app with the default namespace, got %s", namespace)
+	}
+}
+
+func TestTeamAssignments(t *testing.T) {
+	assignments := &teamAssignments{namespaces: map[string][]string{
+		"jx-frontend": {"myorg/web", "myorg/web-*"},
+		"jx-backend":  {"*/api"},
+	}}
+	for _, test := range []struct {
+		namespace string
+		app       string
+		assigned  bool
+	}{
+		{"jx-frontend", "myorg/web", true},
+		{"jx-frontend", "myorg/web-admin", true},
+		{"jx-frontend", "myorg/api", false},
+		{"jx-backend", "otherorg/api", true},
+		{"jx-other", "myorg/web", false},
+	} {
+		parts := strings.SplitN(test.app, "/", 2)
+		if assignments.assigns(test.namespace, parts[0], parts[1]) != test.assigned {
+			t.Errorf("expected %s assigned to %s to be %v", test.app, test.namespace, test.assigned)
+		}
+	}
+}
+
+func TestAPIRejectsTeamStorageAsApps(t *testing.T) {
+	for _, path := range []string{
+		"/api/v1/orgs/.teams/apps/jx-frontend/versions",
+		"/api/v1/orgs/%2Eteams/apps/jx-frontend/versions",
+		"/api/v1/orgs/myorg/apps/%2E%2E/versions",
+		"/api/v1/orgs/myorg/apps/..%2F..%2Fetc/versions",
+		"/api/v1/orgs/.blobs/apps",
+	} {
+		w := httptest.NewRecorder()
+		apiHandler()(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be rejected, got %d", path, w.Code)
+		}
+	}
+}
+
+func TestTeamFileSystemHidesTeamStorage(t *testing.T) {
+	for _, name := range []string{"/.teams/jx-frontend/myorg/web/1.0.0/junit.xml", "/myorg/.blobs/ab"} {
+		if _, _, ok := (teamFileSystem{}).reportDir(name); ok {
+			t.Errorf("expected %s not to be served", name)
+		}
+	}
+}
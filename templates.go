@@ -0,0 +1,232 @@
+package main
+
+// the templates are kept in the binary so the image only needs the executable
+
+const pageStyle = `
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #24292e; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 1.5em; }
+th, td { text-align: left; padding: 0.4em 0.6em; border-bottom: 1px solid #e1e4e8; vertical-align: top; }
+th { background: #f6f8fa; }
+pre { background: #f6f8fa; padding: 0.6em; overflow-x: auto; white-space: pre-wrap; }
+a { color: #0366d6; text-decoration: none; }
+.badge { display: inline-block; padding: 0.1em 0.5em; border-radius: 3px; color: #fff; font-size: 0.85em; }
+.passed, .PASSED { background: #28a745; }
+.failed, .error, .FAILED { background: #d73a49; }
+.skipped, .PENDING { background: #6a737d; }
+.filters a { margin-right: 1em; }
+.filters a.active { font-weight: bold; }
+`
+
+const junitTemplateText = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>` + pageStyle + `</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p>
+  {{.Totals.Tests}} tests, {{.Totals.Passed}} passed, {{.Totals.Failures}} failed, {{.Totals.Errors}} errors,
+  {{.Totals.Skipped}} skipped in {{printf "%.3f" .Totals.Time}}s &middot; <a href="?raw=1">raw XML</a>
+</p>
+<p class="filters">
+  <a href="?" {{if eq .Filter ""}}class="active"{{end}}>all</a>
+  <a href="?status=passed" {{if eq .Filter "passed"}}class="active"{{end}}>passed</a>
+  <a href="?status=failed" {{if eq .Filter "failed"}}class="active"{{end}}>failed</a>
+  <a href="?status=skipped" {{if eq .Filter "skipped"}}class="active"{{end}}>skipped</a>
+</p>
+<h2>Suites</h2>
+<table>
+  <tr><th>Suite</th><th>Tests</th><th>Passed</th><th>Failed</th><th>Errors</th><th>Skipped</th><th>Time (s)</th></tr>
+  {{range $i, $s := .Suites}}
+  <tr>
+    <td><a href="#suite-{{$i}}">{{$s.Name}}</a></td><td>{{$s.Totals.Tests}}</td><td>{{$s.Totals.Passed}}</td>
+    <td>{{$s.Totals.Failures}}</td><td>{{$s.Totals.Errors}}</td><td>{{$s.Totals.Skipped}}</td>
+    <td>{{printf "%.3f" $s.Totals.Time}}</td>
+  </tr>
+  {{end}}
+</table>
+{{range $i, $s := .Suites}}
+<h2 id="suite-{{$i}}">{{$s.Name}}</h2>
+{{if $s.Cases}}
+<table>
+  <tr><th>Test</th><th>Class</th><th>Status</th><th>Time (s)</th></tr>
+  {{range $s.Cases}}
+  <tr>
+    <td>
+      {{.Name}}
+      {{with .Result}}
+      <details {{if ne $.Filter "skipped"}}open{{end}}>
+        <summary>{{if .Type}}{{.Type}}: {{end}}{{.Message}}</summary>
+        {{if .Body}}<pre>{{.Body}}</pre>{{end}}
+      </details>
+      {{end}}
+      {{if .SystemOut}}<details><summary>stdout</summary><pre>{{.SystemOut}}</pre></details>{{end}}
+      {{if .SystemErr}}<details><summary>stderr</summary><pre>{{.SystemErr}}</pre></details>{{end}}
+    </td>
+    <td>{{.Classname}}</td>
+    <td><span class="badge {{.Status}}">{{.Status}}</span></td>
+    <td>{{printf "%.3f" .Time}}</td>
+  </tr>
+  {{end}}
+</table>
+{{else}}
+<p>No matching test cases.</p>
+{{end}}
+{{if $s.SystemOut}}<details><summary>suite stdout</summary><pre>{{$s.SystemOut}}</pre></details>{{end}}
+{{if $s.SystemErr}}<details><summary>suite stderr</summary><pre>{{$s.SystemErr}}</pre></details>{{end}}
+{{end}}
+</body>
+</html>
+`
+
+const portalTemplateText = `
+{{define "header"}}<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>` + pageStyle + `</style>
+</head>
+<body>
+<p>{{range $i, $c := .Crumbs}}{{if $i}} / {{end}}<a href="{{$c.Path}}">{{$c.Name}}</a>{{end}}</p>
+<h1>{{.Title}}</h1>
+{{end}}
+
+{{define "footer"}}
+<p><a href="?raw=1">directory listing</a></p>
+</body>
+</html>
+{{end}}
+
+{{define "status"}}{{if .}}{{if .Status}}<span class="badge {{.Status}}">{{.Status}}</span>{{end}}{{end}}{{end}}
+
+{{define "orgs"}}{{template "header" .}}
+{{if .Orgs}}
+<table>
+  <tr><th>Org</th><th>Apps</th></tr>
+  {{range .Orgs}}<tr><td><a href="{{.Name}}/">{{.Name}}</a></td><td>{{.Apps}}</td></tr>{{end}}
+</table>
+{{else}}<p>No reports have been uploaded yet.</p>{{end}}
+{{template "footer" .}}{{end}}
+
+{{define "apps"}}{{template "header" .}}
+<table>
+  <tr><th>App</th><th>Latest version</th><th>Status</th><th>Coverage</th><th>Updated</th></tr>
+  {{range .Apps}}
+  <tr>
+    <td><a href="{{.Name}}/">{{.Name}}</a></td>
+    <td>{{if .LatestVersion}}<a href="{{.Name}}/{{.LatestVersion}}/">{{.LatestVersion}}</a>{{end}}</td>
+    <td>{{template "status" .Latest}}</td>
+    <td>{{with .Latest}}{{coverage .Coverage}}{{end}}</td>
+    <td>{{timestamp .Updated}}</td>
+  </tr>
+  {{end}}
+</table>
+{{template "footer" .}}{{end}}
+
+{{define "versions"}}{{template "header" .}}
+{{if .Environments}}
+<h2>Environments</h2>
+<table>
+  <tr><th>Environment</th><th>Version</th><th>Status</th><th>Tests</th><th>Coverage</th><th>Promoted</th><th>Links</th></tr>
+  {{range $e := .Environments}}
+  <tr>
+    <td>{{if $e.Label}}{{$e.Label}}{{else}}{{$e.Name}}{{end}}</td>
+    {{with $e.Promotion}}
+    <td><a href="{{.Version}}/">{{.Version}}</a></td>
+    <td>{{template "status" $e.Build}}</td>
+    <td>{{with $e.Build}}{{with .Tests}}{{.Passed}}/{{.Tests}}{{end}}{{end}}</td>
+    <td>{{with $e.Build}}{{coverage .Coverage}}{{end}}</td>
+    <td>{{timestamp .Promoted}}</td>
+    <td>
+      {{if .ApplicationURL}}<a href="{{.ApplicationURL}}">app</a>{{end}}
+      {{if .PullRequestURL}}<a href="{{.PullRequestURL}}">pull request</a>{{end}}
+    </td>
+    {{else}}
+    <td colspan="6">nothing promoted yet</td>
+    {{end}}
+  </tr>
+  {{end}}
+</table>
+<h2>Versions</h2>
+{{end}}
+<table>
+  <tr><th>Version</th><th>Builds</th><th>Status</th><th>Tests</th><th>Coverage</th><th>Updated</th></tr>
+  {{range .Versions}}
+  <tr>
+    <td><a href="{{.Version}}/">{{.Version}}</a></td>
+    <td>{{.Builds}}</td>
+    <td>{{template "status" .Latest}}</td>
+    <td>{{with .Latest}}{{with .Tests}}{{.Passed}}/{{.Tests}}{{end}}{{end}}</td>
+    <td>{{with .Latest}}{{coverage .Coverage}}{{end}}</td>
+    <td>{{timestamp .Updated}}</td>
+  </tr>
+  {{end}}
+</table>
+{{template "footer" .}}{{end}}
+
+{{define "version"}}{{template "header" .}}
+<h2>Builds</h2>
+<table>
+  <tr><th>Build</th><th>Status</th><th>Tests</th><th>Coverage</th><th>Reports</th><th>Updated</th><th>Links</th></tr>
+  {{range .Builds}}
+  <tr>
+    <td>{{.Branch}} #{{.Build}}{{if not .Finalized}} (in progress){{end}}</td>
+    <td>{{template "status" .}}</td>
+    <td>{{with .Tests}}{{.Passed}} passed, {{.Failures}} failed, {{.Errors}} errors, {{.Skipped}} skipped{{end}}</td>
+    <td>{{coverage .Coverage}}</td>
+    <td>{{range .Reports}}<a href="{{.}}">{{.}}</a><br>{{end}}</td>
+    <td>{{timestamp .Updated}}</td>
+    <td>
+      {{with .Activity}}
+      {{if .BuildURL}}<a href="{{.BuildURL}}">build</a>{{end}}
+      {{if .BuildLogsURL}}<a href="{{.BuildLogsURL}}">logs</a>{{end}}
+      {{if .LastCommitURL}}<a href="{{.LastCommitURL}}">commit</a>{{end}}
+      {{end}}
+    </td>
+  </tr>
+  {{end}}
+</table>
+<h2>Reports</h2>
+<ul>
+  {{range .Reports}}<li><a href="{{.Name}}">{{.Name}}</a></li>{{end}}
+</ul>
+{{with .Release}}
+<h2>Release {{.Spec.Version}}</h2>
+{{if .Spec.ReleaseNotesURL}}<p><a href="{{.Spec.ReleaseNotesURL}}">release notes</a></p>{{end}}
+{{if .Spec.Commits}}
+<h3>Commits</h3>
+<table>
+  <tr><th>Commit</th><th>Message</th><th>Author</th></tr>
+  {{range .Spec.Commits}}
+  <tr>
+    <td>{{if .URL}}<a href="{{.URL}}">{{shortSHA .SHA}}</a>{{else}}{{shortSHA .SHA}}{{end}}</td>
+    <td>{{.Message}}</td>
+    <td>{{with .Author}}{{.Login}}{{end}}</td>
+  </tr>
+  {{end}}
+</table>
+{{end}}
+{{if .Spec.Issues}}
+<h3>Issues</h3>
+<table>
+  <tr><th>Issue</th><th>Title</th><th>State</th></tr>
+  {{range .Spec.Issues}}
+  <tr><td>{{if .URL}}<a href="{{.URL}}">{{.ID}}</a>{{else}}{{.ID}}{{end}}</td><td>{{.Title}}</td><td>{{.State}}</td></tr>
+  {{end}}
+</table>
+{{end}}
+{{if .Spec.PullRequests}}
+<h3>Pull requests</h3>
+<table>
+  <tr><th>Pull request</th><th>Title</th><th>State</th></tr>
+  {{range .Spec.PullRequests}}
+  <tr><td>{{if .URL}}<a href="{{.URL}}">{{.ID}}</a>{{else}}{{.ID}}{{end}}</td><td>{{.Title}}</td><td>{{.State}}</td></tr>
+  {{end}}
+</table>
+{{end}}
+{{end}}
+{{template "footer" .}}{{end}}
+`
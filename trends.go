@@ -0,0 +1,170 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+const (
+	// durationWindow is the number of previous builds a test duration is compared against
+	durationWindow = 10
+	// minDurationSamples is the number of previous builds needed before a slowdown is reported
+	minDurationSamples = 5
+	// minDurationIncrease ignores slowdowns below this many seconds, which are mostly noise
+	minDurationIncrease = 0.1
+	// minDurationRatio is the relative slowdown against the rolling median needed for a regression
+	minDurationRatio = 1.2
+	// maxDurationZScore is the robust z-score above which a duration is considered a regression
+	maxDurationZScore = 3.0
+)
+
+// durationTrend describes the recent durations of a test on a branch
+type durationTrend struct {
+	Name        string  `json:"name"`
+	Branch      string  `json:"branch"`
+	Median      float64 `json:"median"`
+	Latest      float64 `json:"latest"`
+	Change      float64 `json:"change"`
+	Samples     int     `json:"samples"`
+	LatestBuild string  `json:"latestBuild"`
+}
+
+// passedDurations returns the durations of the last passing runs, as failing runs often abort early
+func passedDurations(outcomes []testOutcome, excludeBuild string, max int) []float64 {
+	var answer []float64
+	for i := len(outcomes) - 1; i >= 0 && len(answer) < max; i-- {
+		o := outcomes[i]
+		if o.Status != testStatusPassed || o.Build == excludeBuild {
+			continue
+		}
+		answer = append(answer, o.Time)
+	}
+	return answer
+}
+
+func lastPassed(outcomes []testOutcome) testOutcome {
+	for i := len(outcomes) - 1; i >= 0; i-- {
+		if outcomes[i].Status == testStatusPassed {
+			return outcomes[i]
+		}
+	}
+	return testOutcome{}
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
+
+// isDurationRegression compares a duration against the rolling median of the baseline. To count as a regression the
+// slowdown has to be large in absolute and relative terms, and significant given the spread of the baseline, using
+// the median absolute deviation so that a single slow outlier in the baseline doesn't mask or cause a regression.
+func isDurationRegression(current float64, baseline []float64) bool {
+	if len(baseline) < minDurationSamples {
+		return false
+	}
+	m := median(baseline)
+	if current-m < minDurationIncrease || current < m*minDurationRatio {
+		return false
+	}
+	deviations := make([]float64, len(baseline))
+	for i, b := range baseline {
+		deviations[i] = math.Abs(b - m)
+	}
+	// 1.4826 scales the MAD to be comparable with a standard deviation
+	mad := 1.4826 * median(deviations)
+	if mad == 0 {
+		return true
+	}
+	return (current-m)/mad > maxDurationZScore
+}
+
+func newDurationTrend(name string, branch string, latest testOutcome, baseline []float64) durationTrend {
+	m := median(baseline)
+	change := 0.0
+	if m > 0 {
+		change = latest.Time / m
+	}
+	return durationTrend{
+		Name:        name,
+		Branch:      branch,
+		Median:      m,
+		Latest:      latest.Time,
+		Change:      change,
+		Samples:     len(baseline),
+		LatestBuild: latest.Build,
+	}
+}
+
+// durationRegressions returns the tests of a build that are significantly slower than on previous builds of the branch
+func (h *testHistory) durationRegressions(outcomes map[string]testOutcome) []durationTrend {
+	var answer []durationTrend
+	for name, outcome := range outcomes {
+		if outcome.Status != testStatusPassed {
+			continue
+		}
+		baseline := passedDurations(h.Tests[name], outcome.Build, durationWindow)
+		if isDurationRegression(outcome.Time, baseline) {
+			answer = append(answer, newDurationTrend(name, h.Branch, outcome, baseline))
+		}
+	}
+	sortDurationTrends(answer, largerChange)
+	return answer
+}
+
+// slowestTests returns the tests of the branch with the highest median duration over recent passing builds
+func (h *testHistory) slowestTests() []durationTrend {
+	var answer []durationTrend
+	for name, outcomes := range h.Tests {
+		recent := passedDurations(outcomes, "", durationWindow)
+		if len(recent) == 0 {
+			continue
+		}
+		answer = append(answer, newDurationTrend(name, h.Branch, lastPassed(outcomes), recent))
+	}
+	sortDurationTrends(answer, slowerMedian)
+	return answer
+}
+
+// regressedTests returns the tests of the branch whose latest passing run is significantly slower than the runs
+// before it
+func (h *testHistory) regressedTests() []durationTrend {
+	latest := map[string]testOutcome{}
+	for name, outcomes := range h.Tests {
+		last := outcomes[len(outcomes)-1]
+		if last.Status == testStatusPassed {
+			latest[name] = last
+		}
+	}
+	return h.durationRegressions(latest)
+}
+
+// slowerMedian orders duration trends by descending median duration
+func slowerMedian(a durationTrend, b durationTrend) bool {
+	return a.Median > b.Median
+}
+
+// largerChange orders duration trends by descending slowdown
+func largerChange(a durationTrend, b durationTrend) bool {
+	return a.Change > b.Change
+}
+
+func sortDurationTrends(trends []durationTrend, less func(durationTrend, durationTrend) bool) {
+	sort.Slice(trends, func(i, j int) bool {
+		if less(trends[i], trends[j]) || less(trends[j], trends[i]) {
+			return less(trends[i], trends[j])
+		}
+		if trends[i].Name != trends[j].Name {
+			return trends[i].Name < trends[j].Name
+		}
+		return trends[i].Branch < trends[j].Branch
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestMedian(t *testing.T) {
+	for _, test := range []struct {
+		values []float64
+		median float64
+	}{
+		{nil, 0},
+		{[]float64{3}, 3},
+		{[]float64{3, 1, 2}, 2},
+		{[]float64{4, 1, 3, 2}, 2.5},
+	} {
+		if m := median(test.values); m != test.median {
+			t.Errorf("median of %v: got %v, expected %v", test.values, m, test.median)
+		}
+	}
+}
+
+func TestIsDurationRegression(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		current    float64
+		baseline   []float64
+		regression bool
+	}{
+		{"too few samples", 10, []float64{1, 1, 1, 1}, false},
+		{"no change", 1, []float64{1, 1, 1, 1, 1}, false},
+		{"constant baseline doubling", 2, []float64{1, 1, 1, 1, 1}, true},
+		{"below the absolute increase", 0.05, []float64{0.01, 0.01, 0.01, 0.01, 0.01}, false},
+		{"below the relative increase", 11, []float64{10, 10, 10, 10, 10}, false},
+		{"within the spread of a noisy baseline", 1.5, []float64{0.5, 1.5, 0.7, 1.3, 1, 0.6, 1.4}, false},
+		{"outside the spread of a noisy baseline", 3, []float64{0.9, 1.1, 1, 0.95, 1.05}, true},
+		{"a slow outlier doesn't mask a regression", 3, []float64{1, 1, 1.05, 0.95, 1, 30}, true},
+		{"a slow outlier isn't a baseline", 1.1, []float64{1, 1, 1.05, 0.95, 1, 30}, false},
+	} {
+		if regression := isDurationRegression(test.current, test.baseline); regression != test.regression {
+			t.Errorf("%s: got %v, expected %v", test.name, regression, test.regression)
+		}
+	}
+}
+
+func TestPassedDurations(t *testing.T) {
+	history := []testOutcome{
+		{Build: "1", Status: testStatusPassed, Time: 1},
+		{Build: "2", Status: testStatusFailed, Time: 9},
+		{Build: "3", Status: testStatusPassed, Time: 3},
+		{Build: "4", Status: testStatusPassed, Time: 4},
+	}
+	durations := passedDurations(history, "4", 2)
+	if len(durations) != 2 || durations[0] != 3 || durations[1] != 1 {
+		t.Errorf("expected the last two passing durations before build 4, got %v", durations)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	json2 "encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const flakyTestsAnnotation = "jenkins-x-reports-flaky-tests"
+
+// uploadResult is returned to the client once a report has been stored. Clients asking for application/json get
+// the whole result, everyone else gets the historical SUCCESS line followed by one line per finding.
+type uploadResult struct {
+	Status        string      `json:"status"`
+	URL           string      `json:"url,omitempty"`
+	FlakyFailures []flakyTest `json:"flakyFailures,omitempty"`
+	// PerformanceRegressions is only filled in when FLAG_PERFORMANCE_REGRESSIONS is enabled
+	PerformanceRegressions []durationTrend `json:"performanceRegressions,omitempty"`
+	QualityGate            *gateVerdict    `json:"qualityGate,omitempty"`
+	// QuotaWarnings tell which quotas of the org and app are close to being used up
+	QuotaWarnings []string `json:"quotaWarnings,omitempty"`
+}
+
+func writeUploadResult(w http.ResponseWriter, r *http.Request, result *uploadResult) {
+	if result.QualityGate != nil {
+		w.Header().Set("X-Quality-Gate", result.QualityGate.Status)
+	}
+	// quota warnings are only headers, so they don't change the plain text response of uploads that succeed
+	for _, warning := range result.QuotaWarnings {
+		w.Header().Add("X-Quota-Warning", warning)
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		data, _ := json2.Marshal(result)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+	lines := []string{result.Status}
+	for _, ft := range result.FlakyFailures {
+		lines = append(lines, fmt.Sprintf("FLAKY_FAILURE: %s (score %.2f)", ft.Name, ft.Score))
+	}
+	for _, dt := range result.PerformanceRegressions {
+		lines = append(lines, fmt.Sprintf("PERFORMANCE_REGRESSION: %s (%.3fs, median %.3fs)", dt.Name, dt.Latest, dt.Median))
+	}
+	if result.QualityGate != nil {
+		lines = append(lines, fmt.Sprintf("QUALITY_GATE: %s", result.QualityGate.Status))
+		for _, gate := range result.QualityGate.failedGates() {
+			lines = append(lines, fmt.Sprintf("QUALITY_GATE_FAILED: %s (threshold %s, actual %s) %s", gate.Name, gate.Threshold, gate.Actual, gate.Message))
+		}
+	}
+	w.Write([]byte(strings.Join(lines, "\n")))
+}
+
+// annotate records the findings of the upload on the PipelineActivity annotations
+func (result *uploadResult) annotate(annotations map[string]string) {
+	for _, ft := range result.FlakyFailures {
+		line := fmt.Sprintf("- %s: %.2f\n", ft.Name, ft.Score)
+		if !strings.Contains(annotations[flakyTestsAnnotation], fmt.Sprintf("- %s:", ft.Name)) {
+			annotations[flakyTestsAnnotation] += line
+		}
+	}
+	if result.QualityGate != nil {
+		data, _ := json2.Marshal(result.QualityGate)
+		annotations[qualityGateAnnotation] = string(data)
+	}
+}
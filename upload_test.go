@@ -0,0 +1,37 @@
+package main
+
+import (
+	json2 "encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestWriteUploadResultQuotaWarnings(t *testing.T) {
+	warnings := []string{"app myorg/web has used 85% of its quota of 1073741824 bytes",
+		"org myorg has used 90% of its quota of 100000 files"}
+	for _, accept := range []string{"", "text/plain", "application/json"} {
+		r := httptest.NewRequest(http.MethodPost, "/junit.xml", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		writeUploadResult(w, r, &uploadResult{Status: "SUCCESS", QuotaWarnings: warnings})
+		if actual := w.Header()["X-Quota-Warning"]; !reflect.DeepEqual(actual, warnings) {
+			t.Errorf("%q: expected the warnings as headers, got %v", accept, actual)
+		}
+		if accept != "application/json" {
+			if body := w.Body.String(); body != "SUCCESS" {
+				t.Errorf("%q: expected the response to stay SUCCESS, got %q", accept, body)
+			}
+			continue
+		}
+		var result uploadResult
+		err := json2.Unmarshal(w.Body.Bytes(), &result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result.QuotaWarnings, warnings) {
+			t.Errorf("expected the warnings in the JSON response, got %v", result.QuotaWarnings)
+		}
+	}
+}